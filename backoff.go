@@ -0,0 +1,49 @@
+package sshpool
+
+import (
+	"math/rand/v2"
+	"time"
+)
+
+// A Backoff is a policy for retrying failed attempts.
+type Backoff interface {
+	// NextDelay returns how long to wait after the given
+	// attempt (counting from 1) failed with lastErr before
+	// trying again, or giveUp true to stop trying.
+	NextDelay(attempt int, lastErr error) (delay time.Duration, giveUp bool)
+}
+
+// ConstantBackoff waits the same amount of time after
+// every attempt. It never gives up.
+type ConstantBackoff time.Duration
+
+func (b ConstantBackoff) NextDelay(attempt int, lastErr error) (time.Duration, bool) {
+	return time.Duration(b), false
+}
+
+// ExponentialBackoff waits Base after the first attempt,
+// doubling the delay after each subsequent attempt up to Max.
+// It never gives up.
+type ExponentialBackoff struct {
+	Base time.Duration
+	Max  time.Duration // if zero, there is no maximum
+
+	// If true, each delay is chosen uniformly at random
+	// between zero and the exponential delay, so that
+	// many clients failing at once don't retry in lockstep.
+	Jitter bool
+}
+
+func (b ExponentialBackoff) NextDelay(attempt int, lastErr error) (time.Duration, bool) {
+	d := b.Base
+	for i := 1; i < attempt && (b.Max == 0 || d < b.Max); i++ {
+		d *= 2
+	}
+	if b.Max > 0 && d > b.Max {
+		d = b.Max
+	}
+	if b.Jitter && d > 0 {
+		d = rand.N(d)
+	}
+	return d, false
+}
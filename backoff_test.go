@@ -0,0 +1,37 @@
+package sshpool
+
+import (
+	"testing"
+	"time"
+)
+
+func TestConstantBackoff(t *testing.T) {
+	b := ConstantBackoff(time.Second)
+	for attempt := 1; attempt < 5; attempt++ {
+		d, giveUp := b.NextDelay(attempt, nil)
+		if d != time.Second || giveUp {
+			t.Errorf("NextDelay(%d) = %v, %v want 1s, false", attempt, d, giveUp)
+		}
+	}
+}
+
+func TestExponentialBackoff(t *testing.T) {
+	b := ExponentialBackoff{Base: time.Second, Max: 5 * time.Second}
+	want := []time.Duration{1, 2, 4, 5, 5}
+	for i, w := range want {
+		d, giveUp := b.NextDelay(i+1, nil)
+		if d != w*time.Second || giveUp {
+			t.Errorf("NextDelay(%d) = %v, %v want %v, false", i+1, d, giveUp, w*time.Second)
+		}
+	}
+}
+
+func TestExponentialBackoffJitter(t *testing.T) {
+	b := ExponentialBackoff{Base: time.Second, Jitter: true}
+	for i := 0; i < 100; i++ {
+		d, _ := b.NextDelay(3, nil)
+		if d < 0 || d >= 4*time.Second {
+			t.Fatalf("NextDelay(3) = %v want in [0, 4s)", d)
+		}
+	}
+}
@@ -2,25 +2,28 @@ package sshpool_test
 
 import (
 	"bytes"
-	"code.google.com/p/go.crypto/ssh"
 	"github.com/kr/sshpool"
+	"golang.org/x/crypto/ssh"
 	"os"
 )
 
 var config = &ssh.ClientConfig{
 	User: "username",
-	Auth: []ssh.ClientAuth{
-		// ClientAuthPassword wraps a ClientPassword implementation
-		// in a type that implements ClientAuth.
-		ssh.ClientAuthPassword(password("yourpassword")),
+	Auth: []ssh.AuthMethod{
+		ssh.Password("yourpassword"),
 	},
+	HostKeyCallback: ssh.FixedHostKey(hostKey),
 }
 
+// hostKey is the server's public host key, obtained out of band.
+var hostKey ssh.PublicKey
+
 func Example() {
 	sess, err := sshpool.Open("tcp", "127.0.0.1:22", config)
 	if err != nil {
 		panic(err)
 	}
+	defer sess.Close()
 
 	var b bytes.Buffer
 	sess.Stdout = &b
@@ -30,9 +33,3 @@ func Example() {
 	}
 	os.Stdout.Write(b.Bytes())
 }
-
-type password string
-
-func (p password) Password(user string) (string, error) {
-	return string(p), nil
-}
@@ -1,15 +1,29 @@
 package sshpool
 
 import (
-	"code.google.com/p/go.crypto/ssh"
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"golang.org/x/crypto/ssh"
+	"io"
+	"math/rand/v2"
 	"net"
+	"os"
+	"reflect"
+	"runtime"
+	"sort"
 	"strconv"
+	"strings"
 	"sync"
 	"time"
+	"weak"
 )
 
 // Open opens a new SSH session on the given server using DefaultPool.
-func Open(net, addr string, config *ssh.ClientConfig) (*ssh.Session, error) {
+func Open(net, addr string, config *ssh.ClientConfig) (*Session, error) {
 	return DefaultPool.Open(net, addr, config)
 }
 
@@ -17,26 +31,855 @@ type Pool struct {
 	// If nil, net.Dialer is used with the given Timeout.
 	Dial func(net, addr string) (net.Conn, error)
 
+	// If non-nil, DialContext is used instead of Dial. It is passed
+	// the context given to OpenContext, so dialing stops when that
+	// context is canceled.
+	DialContext func(ctx context.Context, net, addr string) (net.Conn, error)
+
 	// Computes a key to distinguish ssh connections.
 	// If nil, AddrUserKey is used.
 	Key func(net, addr string, config *ssh.ClientConfig) string
 
 	// Timeout for Open (for both new and existing
 	// connections). If Dial is not nil, it is up to the Dial func
-	// to enforce the timeout for new connections.
+	// to enforce the timeout while connecting; the pool enforces
+	// it during the SSH handshake that follows.
 	Timeout time.Duration
 
-	tab map[string]*conn
-	mu  sync.Mutex
+	// If positive, DialTimeout bounds each new connection,
+	// and SessionTimeout bounds each attempt to open a session.
+	// Otherwise, the first session attempt gets half of Timeout,
+	// leaving time to redial if it fails. Timeout still bounds
+	// Open as a whole.
+	DialTimeout    time.Duration
+	SessionTimeout time.Duration
+
+	// Socket options for TCP connections made when Dial and
+	// DialContext are nil. If nil, DefaultSockOpts is used.
+	// Connections returned by Dial or DialContext are used as is;
+	// it is up to them to configure the connections.
+	SockOpts *SockOpts
+
+	// If not nil, called with each new network connection, however
+	// it was dialed, before the SSH handshake on it, for example to
+	// tune a *net.TCPConn beyond what SockOpts offers. If it
+	// returns an error, the connection is closed and the dial fails
+	// with that error.
+	AfterDial func(c net.Conn) error
+
+	// When Dial and DialContext are nil, connections to a host
+	// with both IPv6 and IPv4 addresses race the two families as
+	// in RFC 6555, like net.Dialer: the first family, then the
+	// other after a short delay, using whichever connects first.
+	// If DisableHappyEyeballs is true, the addresses are tried
+	// one at a time instead.
+	DisableHappyEyeballs bool
+
+	// If not nil, called before reusing a pooled connection.
+	// If it returns true, the connection is closed (ending any
+	// sessions on it) and a new one is dialed with the current
+	// config, for example after credentials have been rotated.
+	ConnExpired func(info ConnInfo) bool
+
+	// If not nil, called before reusing a pooled connection,
+	// for example to run a cheap command on it. If it returns
+	// an error, the connection is closed and a new one dialed.
+	CheckConn func(c *ssh.Client) error
+
+	// If positive, connections are retired once they are older
+	// than MaxConnLifetime: Open dials a new connection in place
+	// of a retired one, which is closed when its last session
+	// closes.
+	MaxConnLifetime time.Duration
+
+	// If positive, connections are retired, as for MaxConnLifetime,
+	// once MaxSessionsPerConnLifetime sessions have been opened on
+	// them, counting closed ones. This is unlike MaxSessionsPerConn,
+	// which limits sessions open at once.
+	MaxSessionsPerConnLifetime int
+
+	// Maximum number of connections Open tries before giving up,
+	// counting reused connections. If zero, Open keeps trying
+	// until Timeout elapses (forever, if Timeout is also zero).
+	MaxAttempts int
+
+	// If positive, Open retries a failed dial up to DialRetries
+	// times, waiting DialRetryBase before the first retry and
+	// twice as long before each one after, within Timeout. If
+	// Backoff is set, it decides the waits instead, and may give
+	// up sooner. If every dial fails, Open returns the last error.
+	DialRetries   int
+	DialRetryBase time.Duration
+
+	// If true, callers that were waiting on another caller's dial
+	// (see OnSharedDial) don't fail when it fails. Instead, one of
+	// them dials again and the rest share that dial, once. The
+	// caller whose dial failed gets its error as usual.
+	SingleFlightRetry bool
+
+	// Maximum time to wait for the server to accept a new
+	// session, independent of Timeout. A session that takes
+	// longer fails with ErrChannelOpenTimeout, and Open moves
+	// on to a new connection as for any other session failure.
+	// If zero, only Timeout applies.
+	ChannelOpenTimeout time.Duration
+
+	// If not nil, Open calls NewSession to start each session
+	// instead of the connection's own NewSession method, for
+	// example to request a pty or set environment variables the
+	// same way everywhere. Timeout and ChannelOpenTimeout cover
+	// the whole call, and an error is handled like any other
+	// session failure. NewSession must close the session it
+	// opened, if any, before returning an error.
+	NewSession func(c *ssh.Client) (*ssh.Session, error)
+
+	// If not nil, decides how long Open waits before retrying
+	// after a session fails, and whether to give up.
+	// If nil, Open retries immediately. Backoff also paces
+	// DialRetries in place of DialRetryBase.
+	Backoff Backoff
+
+	// If true, when a session fails on a pooled connection, Open
+	// dials exactly one replacement and gives up if that fails too,
+	// rather than retrying until Timeout or MaxAttempts. Failures
+	// on a connection Open just dialed are not retried at all.
+	ReconnectOnce bool
+
+	// Limits how often a new connection is dialed for each key,
+	// independent of whether dials succeed: up to DialBurst dials
+	// at once, refilled at DialRate dials per second. Beyond that,
+	// Open returns ErrDialRateLimited. If DialRate is zero,
+	// dials are not limited.
+	DialRate  float64
+	DialBurst int
+
+	// Limits how quickly sessions are opened on each connection,
+	// to avoid tripping a server's limits when many callers start
+	// at once: up to SessionBurst at once, then SessionRate per
+	// second. Open waits for its turn, up to Timeout. If
+	// SessionRate is zero, session opens are not paced.
+	SessionRate  float64
+	SessionBurst int
+
+	// If GroupFunc is not nil, it assigns each server to a group,
+	// and the pool holds at most MaxConnsPerGroup connections
+	// to the servers in any one group. Beyond that, Open returns
+	// ErrGroupLimit rather than dialing. If MaxConnsPerGroup is
+	// zero, groups are not limited.
+	GroupFunc        func(network, addr string) string
+	MaxConnsPerGroup int
+
+	// If positive, at most MaxDialConcurrency new connections are
+	// dialed at once across the whole pool, to avoid running out
+	// of file descriptors or swamping a proxy when many servers
+	// are opened at once. Further dials wait their turn, up to
+	// Timeout. Reusing a connection doesn't wait.
+	MaxDialConcurrency int
+
+	// If not nil, called with a copy of the config before each
+	// new connection is made. It may return an error to forbid
+	// the connection, or a config to use in its place, for
+	// example to enforce a policy on authentication methods, or
+	// to pick up keys added to an agent since the config was
+	// made. It is not called when Open reuses a connection.
+	ConfigHook func(network, addr string, config *ssh.ClientConfig) (*ssh.ClientConfig, error)
+
+	// If true, configs with no authentication methods are
+	// rejected with ErrNoAuth before dialing, rather than
+	// failing during the handshake.
+	StrictConfig bool
+
+	// If not nil, a floor on the algorithms new connections may
+	// negotiate: a connection that negotiates an algorithm it
+	// disallows is closed after the handshake, and the dial
+	// fails with an error matching ErrWeakAlgorithm. Unlike
+	// restricting the config's algorithms, it applies to every
+	// config the pool dials with.
+	MinAlgorithms *AlgorithmPolicy
+
+	// If true, OpenForwardEnv fails when the server refuses
+	// to set a variable. By default, refusals are ignored.
+	StrictEnv bool
+
+	// If positive, limits how many sessions are open at once on
+	// each connection. When every connection for a server is
+	// full, Open dials another one. If it can't (see DialRate,
+	// MaxConnsPerGroup, and MaxConnsPerKey), Open waits for a
+	// session to close, up to Timeout.
+	MaxSessionsPerConn int
+
+	// If positive, limits how many sessions opened by Open and
+	// its variants are open at once across the whole pool. When
+	// that many are open, Open waits for one to close, up to
+	// Timeout, or fails with ErrMaxSessions if StrictMaxSessions
+	// is set.
+	MaxSessions int
+
+	// If true, Open fails with ErrMaxSessions instead of
+	// waiting when MaxSessions sessions are open.
+	StrictMaxSessions bool
+
+	// If true, Open fails with an error matching ErrSessionLimit
+	// when a server refuses a session because of its own limit
+	// (OpenSSH's MaxSessions). By default, Open instead treats the
+	// connection as full until one of its sessions closes, and
+	// opens the session on another connection, as for
+	// MaxSessionsPerConn.
+	StrictSessionLimit bool
+
+	// If positive, bounds how long Open waits for room on a
+	// server's full connections (see MaxSessionsPerConn), even if
+	// Timeout is longer or zero. A wait that long more likely
+	// means sessions were leaked than that one will close soon,
+	// so Open then logs a warning and fails with an error
+	// matching ErrSessionSlotTimeout.
+	MaxSlotWait time.Duration
+
+	// If positive, limits how many connections MaxSessionsPerConn
+	// may open to any one server, so at most
+	// MaxConnsPerKey*MaxSessionsPerConn sessions are open at once.
+	// The limit applies separately to the connections reserved for
+	// each role (see OpenControl), except that if MaxConnsPerKey
+	// is 1, control and bulk sessions share the one connection.
+	// OpenDial's sessions never do, since they must go through
+	// the caller's dial function.
+	MaxConnsPerKey int
+
+	// If greater than one, Open spreads sessions for each server
+	// across ConnsPerKey connections, dialing them as needed and
+	// then picking the one with the fewest open sessions, taking
+	// turns among equally loaded ones. This suits many small
+	// sessions that would contend on a single transport. When
+	// all of them are full (see MaxSessionsPerConn), Open dials
+	// more as usual.
+	ConnsPerKey int
+
+	// If positive, connections with no open sessions are closed
+	// once they have gone unused for IdleTimeout. A background
+	// goroutine, started by the first Open that needs it and
+	// stopped by Close or by Bind's context, checks for idle
+	// connections.
+	IdleTimeout time.Duration
+
+	// If positive, each connection's IdleTimeout is lengthened
+	// by a random amount less than IdleJitter, so connections
+	// that went idle together, say after a batch job, are closed
+	// over a window rather than all at once.
+	IdleJitter time.Duration
+
+	// If positive, sessions opened by Open and its variants are
+	// closed once they have been open for MaxSessionAge, so a
+	// leaked session can't hold its place on a connection
+	// forever. Like IdleTimeout, a background goroutine checks
+	// for them.
+	MaxSessionAge time.Duration
+
+	// If true, a connection is closed as soon as its last open
+	// session closes, rather than kept for reuse, so connections
+	// exist only while they are in use. Prewarm is then of no
+	// use, since nothing is open on the connection it dials.
+	CloseOnIdle bool
+
+	// If true, the pool is drained, as by Drain, once the context
+	// passed to Bind is done.
+	BindDrain bool
+
+	// If positive, caps the number of connections in the pool.
+	// After a new connection makes the pool exceed it, the least
+	// recently used connections with no open sessions are closed.
+	// Connections with open sessions are never evicted, so the
+	// pool can stay over the cap while they are in use.
+	MaxIdleConns int
+
+	// If positive, each connection is checked every KeepAlive
+	// by sending a keepalive request on it, and is closed and
+	// removed from the pool if the server doesn't reply within
+	// KeepAlive. Unlike a session, the request doesn't count
+	// against the server's MaxSessions. This finds connections
+	// silently dropped by a NAT or firewall before Open tries to
+	// use them, and the round trip of each reply is reported as
+	// ConnInfo.KeepAliveRTT. Like IdleTimeout, the checks run in
+	// a background goroutine.
+	KeepAlive time.Duration
+
+	// If positive, each connection is checked every HealthCheck
+	// by opening a session on it and closing it at once, and is
+	// tagged with the result (see ConnInfo.Health). Unlike
+	// KeepAlive, this finds servers that still answer but refuse
+	// new sessions. Open prefers connections not tagged Degraded;
+	// a connection whose transport fails the check is closed and
+	// removed from the pool. The check is skipped for connections
+	// with no room for another session. Like IdleTimeout, the
+	// checks run in a background goroutine.
+	HealthCheck time.Duration
+
+	// If true, Open doesn't use connections HealthCheck tagged
+	// Degraded, dialing others instead, rather than falling back
+	// on them when there is no healthy one.
+	SkipDegraded bool
+
+	// If not nil, called when HealthCheck finds the first of a
+	// server's connections (see MaxConnsPerKey and ConnsPerKey)
+	// Degraded and Open starts preferring a healthy one, to, for
+	// new sessions. Sessions on the degraded one carry on.
+	OnPromote func(from, to ConnInfo)
+
+	// If positive, Open checks an established connection before
+	// reusing it, by sending a keepalive request and waiting up
+	// to ProbeOnReuse for the reply. If there is none, Open closes
+	// the connection and dials a new one. Connections Open has
+	// just dialed, or waited on another caller to dial, are not
+	// checked.
+	ProbeOnReuse time.Duration
+
+	// If positive, a PersistentSession's Read fails with
+	// ErrStalled once it has waited StallTimeout for output the
+	// command doesn't write, as when the remote process hangs
+	// without exiting. The command is sent SIGKILL and the
+	// PersistentSession is closed.
+	StallTimeout time.Duration
+
+	// Bounds how many keys the pool keeps per-key metadata for,
+	// such as dial rate limits, apart from the connections
+	// themselves. Beyond that, the metadata for the least
+	// recently used key is discarded. If zero, there is no bound.
+	MaxTrackedKeys int
+
+	// If not nil, called when Open has waited for a dial started
+	// by another caller, once that dial finishes, with the result
+	// of the dial. It is not called when Open dials itself or
+	// finds an established connection.
+	OnSharedDial func(info ConnInfo, err error)
+
+	// If not nil, called when the pool has dialed a connection,
+	// with the result; when Open reuses a connection, whether
+	// established or being dialed by another caller; and when the
+	// pool closes a connection, with a short reason such as
+	// "idle", "expired", or "session failed".
+	OnDial  func(network, addr string, err error)
+	OnReuse func(network, addr string)
+	OnClose func(network, addr string, reason string)
+
+	// If not nil, called when the pool closes a session
+	// that has been open longer than MaxSessionAge.
+	OnSessionTimeout func(network, addr string)
+
+	// If not nil, called with debug messages about dials, reuse,
+	// closed connections, and timeouts, for quick diagnostics
+	// without setting every hook.
+	Logf func(format string, args ...interface{})
+
+	// If not nil, receives counts of dials, reuses, and sessions
+	// as they happen, for metrics systems that don't poll Stats.
+	Metrics Collector
+
+	middleware []DialMiddleware
+
+	// Connection state is kept in the root pool;
+	// see Sub.
+	parent  *Pool
+	tab     map[string]*conn
+	limits  map[string]*bucket           // dial rate limits by key
+	lru     *list.List                   // keys in limits, most recent first
+	groups  map[string]int               // conns in tab by group
+	freed   chan struct{}                // closed when a session or conn goes away, or a conn is added
+	drains  map[string]bool              // keys being drained by DrainKey
+	configs map[server]*ssh.ClientConfig // set by Register
+	done    chan struct{}                // closed by Close or Bind to stop background goroutines
+	dialing chan struct{}                // holds a value per dial in progress; see MaxDialConcurrency
+	turn    int                          // rotates ConnsPerKey choices
+	live    int                          // Sessions not yet closed; see MaxSessions
+	opened  map[*ssh.Session]*Session    // Sessions opened and not yet closed
+	reaper  bool
+	sweeper bool
+	pinger  bool
+	checker bool
+	unbound bool // Bind's context is done; see startWorkers
+	closed  bool
+	stats   Stats
+	mu      sync.Mutex
+}
+
+// Stats counts how Open found connections,
+// and the sessions it opened on them.
+type Stats struct {
+	TotalDials    int64 // started a new dial
+	SharedDials   int64 // waited for another caller's dial
+	ReusedConns   int64 // used an established connection
+	TotalSessions int64 // opened a session
+	DialErrors    int64 // started a new dial that failed
+	SessionErrors int64 // failed to open a session on an established connection
+	OpenConns     int   // connections in the pool now, including dials in progress
+	LiveSessions  int   // sessions open or being opened on those connections now
+}
+
+// A Collector receives the pool's events as they happen
+// (see Pool.Metrics). Its methods may be called concurrently.
+type Collector interface {
+	IncDial()                            // dialed a connection, successfully or not
+	IncReuse()                           // reused an established or dialing connection
+	IncSessionOpen()                     // opened a session
+	ObserveDialDuration(d time.Duration) // time taken by a dial and handshake
+}
+
+// nopCollector is the Collector used when Metrics is nil.
+type nopCollector struct{}
+
+func (nopCollector) IncDial()                          {}
+func (nopCollector) IncReuse()                         {}
+func (nopCollector) IncSessionOpen()                   {}
+func (nopCollector) ObserveDialDuration(time.Duration) {}
+
+func (p *Pool) metrics() Collector {
+	if p.Metrics == nil {
+		return nopCollector{}
+	}
+	return p.Metrics
+}
+
+// Stats returns a snapshot of p's counters and connections.
+// A pool returned by Sub shares its parent's counters.
+func (p *Pool) Stats() Stats {
+	r := p.root()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	st := r.stats
+	st.OpenConns = len(r.tab)
+	for _, c := range r.tab {
+		st.LiveSessions += c.sessions
+	}
+	return st
 }
 
+// ErrGroupLimit is returned by Open when a new connection is
+// needed but its group already has MaxConnsPerGroup.
+var ErrGroupLimit = errors.New("sshpool: connection limit for group reached")
+
+// ErrDialRateLimited is returned by Open when a new connection
+// is needed but DialRate does not allow another dial yet.
+var ErrDialRateLimited = errors.New("sshpool: dial rate limit exceeded")
+
 var DefaultPool = new(Pool)
 
+// A DialFunc makes a network connection, like Pool.Dial.
+type DialFunc func(network, addr string) (net.Conn, error)
+
+// A DialMiddleware wraps a DialFunc to add behavior
+// such as logging, metrics, or rate limiting.
+type DialMiddleware func(next DialFunc) DialFunc
+
+// Use adds middleware around the pool's dialing, whether by Dial
+// or the built-in dialer. The first middleware added is outermost:
+// it runs first and sees the final result. Use must not be called
+// concurrently with other methods on p.
+func (p *Pool) Use(mw ...DialMiddleware) {
+	p.middleware = append(p.middleware, mw...)
+}
+
+// SetDial sets p.Dial to fn, safely while p is in use, so that
+// new connections are dialed with fn. If drainOld is true, the
+// connections already in the pool, shared with any Sub pools,
+// are taken out of it: sessions open on them carry on, and each
+// is closed once its last session closes, while new sessions get
+// connections dialed with fn. Otherwise they go on being reused.
+func (p *Pool) SetDial(fn func(network, addr string) (net.Conn, error), drainOld bool) {
+	r := p.root()
+	var idle []*conn
+	r.mu.Lock()
+	p.Dial = fn
+	if drainOld {
+		for k, c := range r.tab {
+			delete(r.tab, k)
+			p.releaseGroup(c)
+			c.cancel()
+			c.retired = true
+			select {
+			case <-c.ok:
+				if c.err == nil && c.sessions == 0 {
+					idle = append(idle, c)
+				}
+			default: // the dialer's place keeps it open
+			}
+		}
+		r.wakeFreed()
+	}
+	r.mu.Unlock()
+	for _, c := range idle {
+		p.closeConn(c, "dialer replaced")
+	}
+}
+
+// Sub returns a new pool that shares p's connections:
+// a connection opened through either pool may be reused
+// by the other. The new pool starts with a copy of p's
+// settings, which can then be changed independently,
+// for example to use a different Timeout. If the pools
+// compute keys differently, they will not find each
+// other's connections.
+func (p *Pool) Sub() *Pool {
+	sub := &Pool{parent: p.root()}
+	dst, src := reflect.ValueOf(sub).Elem(), reflect.ValueOf(p).Elem()
+	for i := 0; i < src.NumField(); i++ {
+		if src.Type().Field(i).IsExported() {
+			dst.Field(i).Set(src.Field(i))
+		}
+	}
+	sub.middleware = append([]DialMiddleware(nil), p.middleware...)
+	return sub
+}
+
+// root returns the pool that holds p's connections.
+func (p *Pool) root() *Pool {
+	if p.parent != nil {
+		return p.parent
+	}
+	return p
+}
+
 // Open starts a new SSH session on the given server, reusing
 // an existing connection if possible. If no connection exists,
 // or if opening the session fails, Open attempts to dial a new
-// connection. If dialing fails, Open returns the error from Dial.
-func (p *Pool) Open(net, addr string, config *ssh.ClientConfig) (*ssh.Session, error) {
+// connection. If dialing fails, Open returns a *DialError.
+// If MaxAttempts or Timeout is reached first, Open returns the
+// last *SessionError, annotated with the bound reached.
+func (p *Pool) Open(network, addr string, config *ssh.ClientConfig) (*Session, error) {
+	return p.OpenContext(context.Background(), network, addr, config)
+}
+
+// OpenContext is like Open, but gives up when ctx is done.
+// A dial in progress is abandoned, and its entry removed from
+// the pool, so the next caller starts afresh. If ctx has a
+// deadline, it bounds Open along with Timeout, whichever
+// comes first.
+func (p *Pool) OpenContext(ctx context.Context, network, addr string, config *ssh.ClientConfig) (*Session, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	info, connect := p.target(network, addr, config)
+	return p.open(ctx, info, connect)
+}
+
+// server identifies a server to Register.
+type server struct{ network, addr string }
+
+// Register sets the config that OpenTo uses for the given server,
+// replacing any config registered for it before.
+func (p *Pool) Register(network, addr string, config *ssh.ClientConfig) {
+	r := p.root()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.configs == nil {
+		r.configs = make(map[server]*ssh.ClientConfig)
+	}
+	r.configs[server{network, addr}] = config
+}
+
+// ErrNotRegistered is returned by OpenTo for a server
+// with no config registered.
+var ErrNotRegistered = errors.New("sshpool: no config registered for server")
+
+// OpenTo is like Open, but uses the config registered for the
+// server with Register. The connection is keyed by that config
+// as usual, so OpenTo and Open share connections.
+func (p *Pool) OpenTo(network, addr string) (*Session, error) {
+	r := p.root()
+	r.mu.Lock()
+	config, ok := r.configs[server{network, addr}]
+	r.mu.Unlock()
+	if !ok {
+		return nil, ErrNotRegistered
+	}
+	return p.Open(network, addr, config)
+}
+
+// Acquire is like Open, but returns the plain *ssh.Session and a
+// func that closes it and releases its place on the connection,
+// for callers that prefer to defer release. Closing the session
+// directly does not release its place; release must be called.
+func (p *Pool) Acquire(network, addr string, config *ssh.ClientConfig) (session *ssh.Session, release func(), err error) {
+	s, err := p.Open(network, addr, config)
+	if err != nil {
+		return nil, nil, err
+	}
+	return s.Session, func() { s.Close() }, nil
+}
+
+// OpenControl is like Open, but opens the session on a separate
+// connection reserved for control sessions, so that
+// latency-sensitive commands don't share a transport with
+// bulk transfers to the same server. The connections for a role
+// belong to the server's key like any other, so CloseConn,
+// DrainKey, and CloseAddr cover them too (see also
+// MaxConnsPerKey).
+func (p *Pool) OpenControl(network, addr string, config *ssh.ClientConfig) (*Session, error) {
+	info, connect := p.target(network, addr, config)
+	info.Role = "control"
+	return p.open(context.Background(), info, connect)
+}
+
+// OpenDial is like Open, but uses dial instead of p.Dial if it
+// needs a new connection. Connections made this way are pooled
+// apart from those made with p.Dial, reserved for the role
+// "dial "+tag (see OpenControl): dial functions given the same
+// tag share connections to a server, and those given different
+// tags don't. Use a tag that names what dial goes through, such
+// as the address of its proxy.
+func (p *Pool) OpenDial(tag string, dial DialFunc, network, addr string, config *ssh.ClientConfig) (*Session, error) {
+	sub := p.Sub()
+	sub.Dial = dial
+	sub.DialContext = nil
+	info, connect := sub.target(network, addr, config)
+	info.Role = "dial " + tag
+	return sub.open(context.Background(), info, connect)
+}
+
+// multiAddrs is the context key for OpenMulti's addresses,
+// any of which a connection's Addr may become once dialed.
+type multiAddrs struct{}
+
+// OpenScored is like Open, but chooses among the server's
+// established connections (see ConnsPerKey and MaxConnsPerKey)
+// the one for which score returns the lowest value, for example
+// the one with the fewest Sessions or the lowest KeepAliveRTT.
+// Until there are ConnsPerKey connections, it dials another
+// instead, and if none has room, it dials as Open would. Score is
+// called with the pool locked, so it must not use the pool.
+func (p *Pool) OpenScored(score func(ConnInfo) float64, network, addr string, config *ssh.ClientConfig) (*Session, error) {
+	info, connect := p.target(network, addr, config)
+	ctx := context.WithValue(context.Background(), scoreFunc{}, score)
+	return p.open(ctx, info, connect)
+}
+
+// scoreFunc is the context key for OpenScored's score function.
+type scoreFunc struct{}
+
+// OpenBulk is like OpenControl, but for bulk transfers: it opens
+// the session on a connection reserved for them, apart from both
+// the control connection and those Open uses.
+func (p *Pool) OpenBulk(network, addr string, config *ssh.ClientConfig) (*Session, error) {
+	info, connect := p.target(network, addr, config)
+	info.Role = "bulk"
+	return p.open(context.Background(), info, connect)
+}
+
+// OpenMulti is like Open, but for a server reachable at several
+// addresses. When it needs a new connection, it tries each of
+// addrs in order until one succeeds. The connection is pooled
+// under key, no matter which address it went to.
+func (p *Pool) OpenMulti(key, network string, addrs []string, config *ssh.ClientConfig) (*Session, error) {
+	info := ConnInfo{Key: key, Network: network, User: config.User}
+	if len(addrs) > 0 {
+		info.Addr = addrs[0]
+	}
+	ctx := context.WithValue(context.Background(), multiAddrs{}, addrs)
+	return p.open(ctx, info, func(ctx context.Context, deadline time.Time, info *ConnInfo) (net.Conn, *ssh.Client, error) {
+		err := errNoAddrs
+		for _, addr := range addrs {
+			netC, sshC, err1 := p.dial(ctx, network, addr, config, deadline, info)
+			if err1 == nil {
+				info.Addr = addr
+				return netC, sshC, nil
+			}
+			err = err1
+		}
+		return nil, nil, err
+	})
+}
+
+var errNoAddrs = errors.New("sshpool: no addresses to dial")
+
+// OpenConn is like Open, but runs SSH over netC, an already
+// established transport, and pools the resulting connection
+// under key rather than a key computed from an address.
+// If the pool already has a working connection for key,
+// OpenConn uses that one and closes netC; netC may be nil
+// in that case.
+func (p *Pool) OpenConn(key string, netC net.Conn, config *ssh.ClientConfig) (*Session, error) {
+	info := ConnInfo{Key: key, User: config.User}
+	if netC != nil {
+		info.Network = netC.RemoteAddr().Network()
+		info.Addr = netC.RemoteAddr().String()
+	}
+	used := netC == nil
+	s, err := p.open(context.Background(), info, func(ctx context.Context, deadline time.Time, info *ConnInfo) (net.Conn, *ssh.Client, error) {
+		config, err := p.hookConfig(info.Network, info.Addr, config)
+		if err != nil {
+			return nil, nil, err
+		}
+		if used {
+			return nil, nil, errNoTransport
+		}
+		used = true
+		netC, sshC, err := handshake(ctx, netC, info.Addr, config, deadline, info)
+		if err == nil {
+			err = p.checkAlgorithms(sshC, info.Algorithms)
+		}
+		if err != nil {
+			err = &DialError{info.Network, info.Addr, err}
+		}
+		return netC, sshC, err
+	})
+	if !used {
+		netC.Close()
+	}
+	return s, err
+}
+
+// Adopt adds client, an SSH connection the caller established, to
+// the pool under the key for network, addr, and config, for Open
+// and its variants to use like one the pool dialed. The pool owns
+// client from then on: it closes client when it would close a
+// connection of its own, as on Close or after IdleTimeout, and the
+// caller must not close it. If the pool already has a connection
+// for the key, Adopt closes client and keeps that one. If the pool
+// can't take client, say because it is closed, Adopt closes client
+// and returns the error. Adopting isn't dialing: it isn't counted
+// as a dial in Stats, Metrics, or OnDial, and it doesn't wait for
+// or count against DialRate, MaxDialConcurrency, MaxConnsPerKey,
+// or MaxConnsPerGroup.
+func (p *Pool) Adopt(network, addr string, config *ssh.ClientConfig, client *ssh.Client) error {
+	info, _ := p.target(network, addr, config)
+	r := p.root()
+	r.mu.Lock()
+	if r.tab == nil {
+		r.tab = make(map[string]*conn)
+	}
+	var err error
+	if r.closed {
+		err = ErrPoolClosed
+	} else if r.drains[info.Key] {
+		err = ErrDraining
+	}
+	if err != nil || len(r.keyConns(info.Key)) > 0 {
+		r.mu.Unlock()
+		client.Close()
+		return err
+	}
+	// An adopted connection wasn't dialed, so it skips the
+	// dial limits and accounting in getConn.
+	p.startWorkers()
+	c := newConn(info)
+	c.c = client
+	c.info.Algorithms = algorithms(client.Conn)
+	c.idle = p.idleTimeout()
+	c.info.Created = time.Now()
+	c.lastUsed = c.info.Created
+	close(c.ok)
+	r.tab[info.Key] = c
+	r.wakeFreed()
+	r.mu.Unlock()
+	go p.watch(c)
+	if p.MaxIdleConns > 0 {
+		p.evict(p.MaxIdleConns)
+	}
+	p.logf("adopted connection to %s %s", network, addr)
+	return nil
+}
+
+var errNoTransport = errors.New("sshpool: no transport to open connection")
+
+// A connectFunc makes a new SSH connection for the pool,
+// recording connection timings in info. It gives up
+// when ctx is done.
+type connectFunc func(ctx context.Context, deadline time.Time, info *ConnInfo) (net.Conn, *ssh.Client, error)
+
+// target returns the pool entry info for the given server
+// and a connectFunc that dials it.
+func (p *Pool) target(network, addr string, config *ssh.ClientConfig) (ConnInfo, connectFunc) {
+	info := ConnInfo{
+		Key:     p.key(network, addr, config),
+		Network: network,
+		Addr:    addr,
+		User:    config.User,
+	}
+	return info, func(ctx context.Context, deadline time.Time, info *ConnInfo) (net.Conn, *ssh.Client, error) {
+		return p.dial(ctx, network, addr, config, deadline, info)
+	}
+}
+
+// ErrTimeout matches errors from Open caused by Timeout or
+// a context deadline, whether dialing, waiting, or opening
+// a session, and errors from CloseTimeout.
+var ErrTimeout = errors.New("sshpool: timed out")
+
+// A DialError reports a failure to connect to a server,
+// either dialing or in the SSH handshake.
+type DialError struct {
+	Network, Addr string
+	Err           error
+}
+
+func (e *DialError) Error() string {
+	return "sshpool: dial " + e.Network + " " + e.Addr + ": " + e.Err.Error()
+}
+
+func (e *DialError) Unwrap() error { return e.Err }
+
+// Is reports whether the dial timed out, for errors.Is(err, ErrTimeout).
+func (e *DialError) Is(target error) bool {
+	return target == ErrTimeout && isTimeout(e.Err)
+}
+
+// A SessionError reports a failure to open a session on an
+// established connection. Open retries these (see MaxAttempts),
+// so it usually returns one wrapped in a summary of its attempts.
+type SessionError struct {
+	Network, Addr string
+	Err           error
+}
+
+func (e *SessionError) Error() string {
+	return "sshpool: session on " + e.Network + " " + e.Addr + ": " + e.Err.Error()
+}
+
+func (e *SessionError) Unwrap() error { return e.Err }
+
+// unprefixed is err with any "sshpool: " prefix trimmed from its
+// text, for wrapping in another of the package's errors.
+type unprefixed struct{ err error }
+
+func (e unprefixed) Error() string { return strings.TrimPrefix(e.err.Error(), "sshpool: ") }
+func (e unprefixed) Unwrap() error { return e.err }
+
+// attempts formats n as a count of attempts.
+func attempts(n int) string {
+	if n == 1 {
+		return "1 attempt"
+	}
+	return strconv.Itoa(n) + " attempts"
+}
+
+// Is reports whether opening the session timed out, for
+// errors.Is(err, ErrTimeout), or the server refused it because
+// too many sessions were open, for errors.Is(err, ErrSessionLimit).
+func (e *SessionError) Is(target error) bool {
+	switch target {
+	case ErrTimeout:
+		return isTimeout(e.Err)
+	case ErrSessionLimit:
+		var oce *ssh.OpenChannelError
+		return errors.As(e.Err, &oce) && oce.Reason == ssh.Prohibited
+	}
+	return false
+}
+
+// ErrSessionLimit matches errors from Open caused by the server
+// refusing a session, as OpenSSH does when its MaxSessions limit
+// is reached (see StrictSessionLimit).
+var ErrSessionLimit = errors.New("sshpool: server refused session")
+
+func isTimeout(err error) bool {
+	return errors.Is(err, os.ErrDeadlineExceeded) || errors.Is(err, context.DeadlineExceeded)
+}
+
+// open starts a new session on the connection for info.Key,
+// calling connect to make a new connection when needed.
+func (p *Pool) open(ctx context.Context, info ConnInfo, connect connectFunc) (s *Session, err error) {
+	defer func() {
+		if errors.Is(err, ErrTimeout) {
+			p.logf("timed out opening session on %s %s: %v", info.Network, info.Addr, err)
+		}
+	}()
 	var deadline, sessionDeadline time.Time
 	if p.Timeout > 0 {
 		now := time.Now()
@@ -47,100 +890,2444 @@ func (p *Pool) Open(net, addr string, config *ssh.ClientConfig) (*ssh.Session, e
 		// Dial and NewSession.
 		sessionDeadline = now.Add(p.Timeout / 2)
 	}
-	k := p.key(net, addr, config)
-	for {
-		c := p.getConn(k, net, addr, config, deadline)
+	if d, ok := ctx.Deadline(); ok && (deadline.IsZero() || d.Before(deadline)) {
+		deadline = d
+		if sessionDeadline.IsZero() || d.Before(sessionDeadline) {
+			sessionDeadline = d
+		}
+	}
+	if err := p.takeSession(ctx, deadline); err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err != nil {
+			p.releaseLive()
+		}
+	}()
+	for attempt := 1; ; attempt++ {
+		c, dialed := p.getConn(ctx, info, connect, deadline)
+		var dialErr *DialError
+		for retry := 1; retry <= p.DialRetries && errors.As(c.err, &dialErr); retry++ {
+			p.removeConn(c.info.Key, c)
+			var b Backoff = ExponentialBackoff{Base: p.DialRetryBase}
+			if p.Backoff != nil {
+				b = p.Backoff
+			}
+			d, giveUp := b.NextDelay(retry, c.err)
+			if giveUp {
+				break
+			}
+			if !deadline.IsZero() && time.Now().Add(d).After(deadline) {
+				break
+			}
+			if err := sleep(ctx, d); err != nil {
+				return nil, err
+			}
+			c, dialed = p.getConn(ctx, info, connect, deadline)
+		}
 		if c.err != nil {
-			p.removeConn(k, c)
+			p.removeConn(c.info.Key, c)
 			return nil, c.err
 		}
-		s, err := c.newSession(sessionDeadline)
+		if err := p.paceSession(ctx, c, deadline); err != nil {
+			p.releaseSession(c)
+			return nil, err
+		}
+		if p.SessionTimeout > 0 {
+			sessionDeadline = earliest(deadline, time.Now().Add(p.SessionTimeout))
+		}
+		s, err := c.newSession(ctx, sessionDeadline, p.ChannelOpenTimeout, p.NewSession)
+		if err != nil && ctxErr(ctx) == nil {
+			err = &SessionError{c.info.Network, c.info.Addr, err}
+			r := p.root()
+			r.mu.Lock()
+			r.stats.SessionErrors++
+			r.mu.Unlock()
+		}
 		if err == nil {
-			return s, nil
+			ps := &Session{Session: s, p: p, c: c, opened: time.Now()}
+			r := p.root()
+			r.mu.Lock()
+			r.stats.TotalSessions++
+			if r.opened == nil {
+				r.opened = make(map[*ssh.Session]*Session)
+			}
+			r.opened[s] = ps
+			r.mu.Unlock()
+			p.metrics().IncSessionOpen()
+			return ps, nil
+		}
+		p.releaseSession(c)
+		if err := ctxErr(ctx); err != nil {
+			// The connection is fine; the caller gave up.
+			return nil, err
+		}
+		if errors.Is(err, ErrSessionLimit) {
+			if p.StrictSessionLimit {
+				return nil, err
+			}
+			if p.limitSessions(c) {
+				continue // look for room on another connection
+			}
 		}
 		sessionDeadline = deadline
-		p.removeConn(k, c)
-		c.c.Close()
-		if p.Timeout > 0 && time.Now().After(deadline) {
+		p.removeConn(c.info.Key, c)
+		p.closeConn(c, "session failed")
+		if p.ReconnectOnce && (dialed || attempt > 1) {
+			return nil, fmt.Errorf("sshpool: gave up after reconnecting: %w", unprefixed{err})
+		}
+		if p.MaxAttempts > 0 && attempt >= p.MaxAttempts {
+			return nil, fmt.Errorf("sshpool: gave up after %s: %w", attempts(attempt), unprefixed{err})
+		}
+		if !deadline.IsZero() && time.Now().After(deadline) {
+			return nil, fmt.Errorf("%w after %s: %w", ErrTimeout, attempts(attempt), unprefixed{err})
+		}
+		if p.Backoff != nil {
+			d, giveUp := p.Backoff.NextDelay(attempt, err)
+			if giveUp {
+				return nil, fmt.Errorf("sshpool: gave up after %s: %w", attempts(attempt), unprefixed{err})
+			}
+			if !deadline.IsZero() && time.Now().Add(d).After(deadline) {
+				return nil, fmt.Errorf("%w after %s: %w", ErrTimeout, attempts(attempt), unprefixed{err})
+			}
+			if err := sleep(ctx, d); err != nil {
+				return nil, err
+			}
+		}
+	}
+}
+
+// OpenForwardEnv is like Open, but also sets each variable named
+// in allow on the new session to its value in the local
+// environment, like ssh's SendEnv option. Variables not set
+// locally are skipped.
+func (p *Pool) OpenForwardEnv(network, addr string, config *ssh.ClientConfig, allow []string) (*Session, error) {
+	s, err := p.Open(network, addr, config)
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range allow {
+		value, ok := os.LookupEnv(name)
+		if !ok {
+			continue
+		}
+		if err := s.Setenv(name, value); err != nil && p.StrictEnv {
+			s.Close()
 			return nil, err
 		}
 	}
+	return s, nil
 }
 
-type conn struct {
-	netC net.Conn
-	c    *ssh.ClientConn
-	ok   chan bool
-	err  error
+// ConnContext returns a context that is canceled when the pool
+// discards its connection to the given server, dialing the
+// connection first if necessary.
+func (p *Pool) ConnContext(network, addr string, config *ssh.ClientConfig) (context.Context, error) {
+	var deadline time.Time
+	if p.Timeout > 0 {
+		deadline = time.Now().Add(p.Timeout)
+	}
+	info, connect := p.target(network, addr, config)
+	c, _ := p.getConn(context.Background(), info, connect, deadline)
+	if c.err != nil {
+		p.removeConn(c.info.Key, c)
+		return nil, c.err
+	}
+	p.releaseSession(c)
+	return c.ctx, nil
 }
 
-func (c *conn) newSession(deadline time.Time) (*ssh.Session, error) {
-	if !deadline.IsZero() {
-		c.netC.SetDeadline(deadline)
-		defer c.netC.SetDeadline(time.Time{})
+// Prewarm dials a connection to the given server without opening
+// a session, so that a later Open finds it ready. If the pool
+// already has the connection, Prewarm does nothing.
+func (p *Pool) Prewarm(network, addr string, config *ssh.ClientConfig) error {
+	_, err := p.ConnContext(network, addr, config)
+	return err
+}
+
+// WaitForConn waits until the pool has an established connection
+// to the given server, such as one being dialed by Prewarm or
+// Open, or until ctx is done. It does not dial.
+func (p *Pool) WaitForConn(ctx context.Context, network, addr string, config *ssh.ClientConfig) error {
+	k := p.key(network, addr, config)
+	r := p.root()
+	for {
+		r.mu.Lock()
+		if p.readyConn(k) != nil {
+			r.mu.Unlock()
+			return nil
+		}
+		var dialing *conn
+		for _, c := range r.keyConns(k) {
+			select {
+			case <-c.ok: // failed; wait for a new dial
+			default:
+				dialing = c
+			}
+		}
+		if dialing == nil {
+			// A new connection in tab wakes freed.
+			if err := p.waitFreed(ctx, time.Time{}); err != nil {
+				return err
+			}
+			continue
+		}
+		r.mu.Unlock()
+		select {
+		case <-dialing.ok:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
 	}
-	return c.c.NewSession()
 }
 
-// getConn gets an ssh connection from the pool for key.
-// If none is available, it dials anew.
-func (p *Pool) getConn(k, net, addr string, config *ssh.ClientConfig, deadline time.Time) *conn {
-	p.mu.Lock()
-	if p.tab == nil {
-		p.tab = make(map[string]*conn)
+// ConnInfo describes a pooled connection.
+type ConnInfo struct {
+	Key     string
+	Network string
+	Addr    string
+	User    string
+	Created time.Time // when dialing finished
+	Role    string    // "control", "bulk", or "dial " plus a tag; see OpenControl
+
+	ConnectDuration   time.Duration // establishing the transport
+	HandshakeDuration time.Duration // SSH key exchange and auth
+	KeepAliveRTT      time.Duration // round trip of the last keepalive answered, if any
+	Health            Health        // as of the last HealthCheck
+	Sessions          int           // open or opening, when the ConnInfo was made
+
+	// Algorithms are those negotiated in the SSH handshake,
+	// for auditing (see also MinAlgorithms).
+	Algorithms ssh.NegotiatedAlgorithms
+}
+
+// Health is a connection's state as last found by HealthCheck.
+type Health int
+
+const (
+	Healthy  Health = iota // opened a session, or not checked yet
+	Degraded               // the server refused a session
+	Dead                   // the transport failed; the connection is closed
+)
+
+func (h Health) String() string {
+	switch h {
+	case Healthy:
+		return "healthy"
+	case Degraded:
+		return "degraded"
+	case Dead:
+		return "dead"
 	}
-	c, ok := p.tab[k]
-	if ok {
-		p.mu.Unlock()
-		<-c.ok
-		return c
+	return "Health(" + strconv.Itoa(int(h)) + ")"
+}
+
+// Len returns the number of connections in the pool,
+// including dials in progress.
+func (p *Pool) Len() int {
+	r := p.root()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.tab)
+}
+
+// Keys returns the keys of the connections in the pool, sorted.
+// See Len.
+func (p *Pool) Keys() []string {
+	r := p.root()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	keys := make([]string, 0, len(r.tab))
+	for k := range r.tab {
+		keys = append(keys, k)
 	}
-	c = &conn{ok: make(chan bool)}
-	p.tab[k] = c
-	p.mu.Unlock()
-	c.netC, c.c, c.err = p.dial(net, addr, config, deadline)
-	close(c.ok)
-	return c
+	sort.Strings(keys)
+	return keys
 }
 
-// removeConn removes c1 from the pool if present.
-func (p *Pool) removeConn(k string, c1 *conn) {
-	p.mu.Lock()
-	defer p.mu.Unlock()
-	c, ok := p.tab[k]
-	if ok && c == c1 {
-		delete(p.tab, k)
+// ForEachConn calls fn for each established connection in the
+// pool, for maintenance the pool doesn't do itself. It calls fn
+// outside the pool's lock, on a snapshot of the connections, so fn
+// may use the pool; connections added or removed meanwhile may or
+// may not be visited. Like Client, fn must not close c.
+func (p *Pool) ForEachConn(fn func(network, addr string, c *ssh.Client)) {
+	r := p.root()
+	var conns []*conn
+	r.mu.Lock()
+	for _, c := range r.tab {
+		select {
+		case <-c.ok:
+			if c.err == nil {
+				conns = append(conns, c)
+			}
+		default: // still dialing
+		}
+	}
+	r.mu.Unlock()
+	for _, c := range conns {
+		fn(c.info.Network, c.info.Addr, c.c)
 	}
 }
 
-func (p *Pool) dial(network, addr string, config *ssh.ClientConfig, deadline time.Time) (net.Conn, *ssh.ClientConn, error) {
-	dial := p.Dial
-	if dial == nil {
-		dialer := net.Dialer{Deadline: deadline}
-		dial = dialer.Dial
+// Client returns the pool's connection to the given server,
+// dialing if needed, for uses that need the connection itself,
+// such as port forwarding or SFTP. The connection is shared, so
+// don't close it; call release when done with it instead. Until
+// then, it counts as a session open on the connection (see
+// MaxSessionsPerConn and IdleTimeout). This makes each call a
+// reference to the connection: the pool doesn't close it for
+// being idle, or evict it for MaxIdleConns, until every caller
+// holding it has called release.
+func (p *Pool) Client(network, addr string, config *ssh.ClientConfig) (client *ssh.Client, release func(), err error) {
+	return p.client(context.Background(), network, addr, config)
+}
+
+func (p *Pool) client(ctx context.Context, network, addr string, config *ssh.ClientConfig) (client *ssh.Client, release func(), err error) {
+	var deadline time.Time
+	if p.Timeout > 0 {
+		deadline = time.Now().Add(p.Timeout)
 	}
-	netC, err := dial(network, addr)
-	if err != nil {
-		return nil, nil, err
+	info, connect := p.target(network, addr, config)
+	c, _ := p.getConn(ctx, info, connect, deadline)
+	if c.err != nil {
+		p.removeConn(c.info.Key, c)
+		return nil, nil, c.err
 	}
-	sshC, err := ssh.Client(netC, config)
+	var once sync.Once
+	return c.c, func() { once.Do(func() { p.releaseSession(c) }) }, nil
+}
+
+// ServerVersion returns the version string the given server sent
+// when the pool connected to it, such as "SSH-2.0-OpenSSH_8.9",
+// dialing first if necessary.
+func (p *Pool) ServerVersion(network, addr string, config *ssh.ClientConfig) ([]byte, error) {
+	client, release, err := p.Client(network, addr, config)
 	if err != nil {
-		netC.Close()
-		return nil, nil, err
+		return nil, err
 	}
-	return netC, sshC, nil
+	defer release()
+	return client.ServerVersion(), nil
 }
 
-func (p *Pool) key(net, addr string, config *ssh.ClientConfig) string {
-	key := p.Key
-	if key == nil {
-		key = AddrUserKey
+// JumpDial returns a DialFunc that reaches its targets through
+// the server at network, addr, like ssh -J. The connection to the
+// jump host comes from p and is shared by every target dialed
+// through it; each tunnel counts as a session on that connection
+// until the tunneled net.Conn is closed.
+//
+// Targets are keyed by their own address, as usual, and the jump
+// host by its address. A pool whose Dial is a JumpDial therefore
+// finds the same target connections as a pool dialing the targets
+// directly; if both are in use, give the jumping pool a Key that
+// includes the jump host. Tunneled connections don't support
+// deadlines, so Timeout does not bound their handshakes.
+//
+// Dialing the jump host doesn't wait for a turn under
+// MaxDialConcurrency: it happens within the target's dial,
+// which has a turn already, and waiting for another would
+// deadlock a pool whose turns were all taken by such dials.
+func (p *Pool) JumpDial(network, addr string, config *ssh.ClientConfig) DialFunc {
+	return func(tnetwork, taddr string) (net.Conn, error) {
+		ctx := context.WithValue(context.Background(), nestedDial{}, true)
+		client, release, err := p.client(ctx, network, addr, config)
+		if err != nil {
+			return nil, err
+		}
+		c, err := client.Dial(tnetwork, taddr)
+		if err != nil {
+			release()
+			return nil, err
+		}
+		return &jumpConn{Conn: c, release: release}, nil
 	}
-	return key(net, addr, config)
 }
 
-// Returns a distinct string for any unique combination of net,
-// addr, and config.User.
-func AddrUserKey(net, addr string, config *ssh.ClientConfig) string {
-	return strconv.Quote(net) + " " + strconv.Quote(addr) + " " + strconv.Quote(config.User)
+// nestedDial marks the context of a dial made within another
+// dial, which doesn't wait for a turn (see waitDial).
+type nestedDial struct{}
+
+// jumpConn is a connection tunneled through a jump host.
+// Closing it releases the jump host connection.
+type jumpConn struct {
+	net.Conn
+	release func()
+}
+
+func (c *jumpConn) Close() error {
+	err := c.Conn.Close()
+	c.release()
+	return err
+}
+
+// Info returns information about the pooled connection to the
+// given server, if there is one. It does not dial.
+func (p *Pool) Info(network, addr string, config *ssh.ClientConfig) (ConnInfo, bool) {
+	k := p.key(network, addr, config)
+	r := p.root()
+	r.mu.Lock()
+	c := p.readyConn(k)
+	var info ConnInfo
+	if c != nil {
+		info = c.snapshot()
+	}
+	r.mu.Unlock()
+	return info, c != nil
+}
+
+// Algorithms returns the algorithms negotiated for the pooled
+// connection to the given server, if there is one, as in its
+// ConnInfo. It does not dial.
+func (p *Pool) Algorithms(network, addr string, config *ssh.ClientConfig) (ssh.NegotiatedAlgorithms, bool) {
+	info, ok := p.Info(network, addr, config)
+	return info.Algorithms, ok
+}
+
+// OpenPersistent starts cmd on the given server, like
+// Session.Start, and returns a PersistentSession whose Read and
+// Write use the command's standard output and input. If the
+// connection drops, the PersistentSession opens a new session,
+// dialing if need be, and starts cmd again. Data in flight when
+// the connection dropped is lost, not replayed: output the old
+// command wrote that Read hadn't returned, and input Write had
+// sent that the old command hadn't read. Use it for commands
+// that can pick up where a predecessor left off, such as a
+// stream of log lines or a request loop.
+func (p *Pool) OpenPersistent(network, addr string, config *ssh.ClientConfig, cmd string) (*PersistentSession, error) {
+	ps := &PersistentSession{p: p, network: network, addr: addr, config: config, cmd: cmd}
+	if err := ps.restart(nil); err != nil {
+		return nil, err
+	}
+	return ps, nil
+}
+
+// A PersistentSession is a command that is started again on a
+// new session when its connection drops (see OpenPersistent).
+// Read and Write may be called concurrently with each other.
+// Once the command exits, Read returns io.EOF.
+type PersistentSession struct {
+	p             *Pool
+	network, addr string
+	config        *ssh.ClientConfig
+	cmd           string
+
+	mu     sync.Mutex
+	run    *persistentRun
+	closed bool
+	err    error // why closed, if not by Close
+}
+
+// A persistentRun is one session of a PersistentSession.
+type persistentRun struct {
+	s      *Session
+	stdin  io.Writer
+	stdout io.Reader
+	once   sync.Once
+	err    error
+}
+
+// wait waits for the command to finish, once for all callers.
+func (r *persistentRun) wait() error {
+	r.once.Do(func() { r.err = r.s.Wait() })
+	return r.err
+}
+
+// dropped reports whether the command ended because
+// its connection dropped, rather than by exiting.
+func (r *persistentRun) dropped() bool {
+	err := r.wait()
+	return err != nil && !isExitError(err)
+}
+
+func (ps *PersistentSession) current() (*persistentRun, error) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	if ps.closed {
+		return nil, ps.closedErr()
+	}
+	return ps.run, nil
+}
+
+// closedErr returns the error for using ps once it is closed.
+// The caller must hold ps.mu.
+func (ps *PersistentSession) closedErr() error {
+	if ps.err != nil {
+		return ps.err
+	}
+	return net.ErrClosed
+}
+
+// restart replaces old, if it is still the current run,
+// with a new one.
+func (ps *PersistentSession) restart(old *persistentRun) error {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	if ps.closed {
+		return ps.closedErr()
+	}
+	if ps.run != old {
+		return nil // another caller restarted it
+	}
+	if old != nil {
+		old.s.Close()
+	}
+	s, err := ps.p.Open(ps.network, ps.addr, ps.config)
+	if err != nil {
+		return err
+	}
+	r := &persistentRun{s: s}
+	if r.stdin, err = s.StdinPipe(); err == nil {
+		if r.stdout, err = s.StdoutPipe(); err == nil {
+			err = s.Start(ps.cmd)
+		}
+	}
+	if err != nil {
+		s.Close()
+		return err
+	}
+	ps.run = r
+	return nil
+}
+
+// Read reads from the command's standard output.
+func (ps *PersistentSession) Read(b []byte) (int, error) {
+	for {
+		r, err := ps.current()
+		if err != nil {
+			return 0, err
+		}
+		n, err := ps.read(r, b)
+		if n > 0 || err == nil {
+			return n, nil
+		}
+		if err == ErrStalled {
+			return 0, err
+		}
+		if !r.dropped() {
+			return 0, io.EOF
+		}
+		if err := ps.restart(r); err != nil {
+			return 0, err
+		}
+	}
+}
+
+// read reads from r's standard output, within StallTimeout
+// if that is set; if the command stalls, read closes ps.
+func (ps *PersistentSession) read(r *persistentRun, b []byte) (int, error) {
+	d := ps.p.StallTimeout
+	if d <= 0 {
+		return r.stdout.Read(b)
+	}
+	stalled := make(chan struct{})
+	t := time.AfterFunc(d, func() {
+		defer close(stalled)
+		ps.mu.Lock()
+		defer ps.mu.Unlock()
+		if ps.closed || ps.run != r {
+			return
+		}
+		ps.closed, ps.err = true, ErrStalled
+		r.s.Signal(ssh.SIGKILL)
+		r.s.Close()
+	})
+	n, err := r.stdout.Read(b)
+	if !t.Stop() {
+		<-stalled
+		if n == 0 {
+			err = ErrStalled
+		}
+	}
+	return n, err
+}
+
+// ErrStalled is returned by a PersistentSession's Read when
+// its command wrote no output for StallTimeout.
+var ErrStalled = errors.New("sshpool: command stalled")
+
+// Write writes to the command's standard input.
+func (ps *PersistentSession) Write(b []byte) (int, error) {
+	written := 0
+	for {
+		r, err := ps.current()
+		if err != nil {
+			return written, err
+		}
+		n, err := r.stdin.Write(b[written:])
+		written += n
+		if err == nil {
+			return written, nil
+		}
+		if !r.dropped() {
+			return written, err
+		}
+		if err := ps.restart(r); err != nil {
+			return written, err
+		}
+	}
+}
+
+// Close closes the session. Further calls to
+// Read and Write return net.ErrClosed.
+func (ps *PersistentSession) Close() error {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	if ps.closed {
+		return net.ErrClosed
+	}
+	ps.closed = true
+	return ps.run.s.Close()
+}
+
+// ErrCommandNotFound is returned by RunIfPresent when
+// the remote command's program does not exist.
+var ErrCommandNotFound = errors.New("sshpool: command not found")
+
+// RunIfPresent runs cmd on the given server and returns its
+// standard output, like Session.Output, but first checks with
+// "command -v" that the program named by the first word of cmd
+// exists there, returning ErrCommandNotFound if not. This tells
+// a missing program apart from a command that fails.
+// It uses two sessions on the pooled connection.
+func (p *Pool) RunIfPresent(network, addr string, config *ssh.ClientConfig, cmd string) ([]byte, error) {
+	name := commandName(cmd)
+	if name == "" {
+		return nil, ErrCommandNotFound
+	}
+	s, err := p.Open(network, addr, config)
+	if err != nil {
+		return nil, err
+	}
+	err = s.Run("command -v " + shellQuote(name) + " >/dev/null")
+	s.Close()
+	if isExitError(err) {
+		return nil, fmt.Errorf("%w: %s", ErrCommandNotFound, name)
+	} else if err != nil {
+		return nil, err
+	}
+	return p.output(network, addr, config, cmd)
+}
+
+// RunRetry runs cmd on the given server and returns its standard
+// output, like Session.Output. If the attempt fails at the
+// connection level (a DialError or SessionError, or the
+// connection dropping mid-command so the command's exit status
+// never arrives), RunRetry tries again, up to maxRetries more
+// times. Other errors, including the command exiting
+// unsuccessfully, are returned at once. Only use it for commands
+// that are safe to run more than once.
+func (p *Pool) RunRetry(network, addr string, config *ssh.ClientConfig, cmd string, maxRetries int) ([]byte, error) {
+	for i := 0; ; i++ {
+		out, err := p.output(network, addr, config, cmd)
+		if err == nil || !retryable(err) || i >= maxRetries {
+			return out, err
+		}
+	}
+}
+
+// retryable reports whether err, from running a command,
+// is a connection-level failure worth another attempt.
+func retryable(err error) bool {
+	var de *DialError
+	var se *SessionError
+	var me *ssh.ExitMissingError
+	return errors.As(err, &de) || errors.As(err, &se) ||
+		errors.As(err, &me) || errors.Is(err, io.EOF)
+}
+
+func (p *Pool) output(network, addr string, config *ssh.ClientConfig, cmd string) ([]byte, error) {
+	s, err := p.Open(network, addr, config)
+	if err != nil {
+		return nil, err
+	}
+	defer s.Close()
+	out, err := s.Output(cmd)
+	if e, ok := err.(*ssh.ExitError); ok {
+		err = &RunError{Status: e.ExitStatus(), Signal: e.Signal(), Err: e}
+	}
+	return out, err
+}
+
+// A RunError reports a remote command, run by RunIfPresent or
+// RunRetry, that exited unsuccessfully or was killed by a signal.
+type RunError struct {
+	Status int    // exit status; 128 plus the signal number if killed
+	Signal string // signal that killed the command, such as "KILL", if any
+	Err    error  // the *ssh.ExitError
+}
+
+func (e *RunError) Error() string {
+	if e.Signal != "" {
+		return "sshpool: command killed by signal " + e.Signal
+	}
+	return "sshpool: command exited with status " + strconv.Itoa(e.Status)
+}
+
+func (e *RunError) Unwrap() error { return e.Err }
+
+// isExitError reports whether err says that a remote
+// command ran and exited unsuccessfully.
+func isExitError(err error) bool {
+	var e *ssh.ExitError
+	return errors.As(err, &e)
+}
+
+// commandName returns the first word of the shell command cmd.
+func commandName(cmd string) string {
+	f := strings.Fields(cmd)
+	if len(f) == 0 {
+		return ""
+	}
+	return f[0]
+}
+
+// shellQuote quotes s for a POSIX shell.
+func shellQuote(s string) string {
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
+
+type conn struct {
+	netC net.Conn
+	c    *ssh.Client
+	ok   chan bool
+	err  error
+	info ConnInfo
+	pace *bucket // session rate limit; guarded by root pool's mu
+
+	sessions int           // open or opening; guarded by root pool's mu
+	limit    int           // sessions the server allows, if known; guarded by root pool's mu
+	served   int           // places ever taken; guarded by root pool's mu
+	retired  bool          // close when sessions reaches 0; guarded by root pool's mu
+	lastUsed time.Time     // guarded by root pool's mu
+	rtt      time.Duration // of the last keepalive; guarded by root pool's mu
+	health   Health        // guarded by root pool's mu
+	base     string        // key given to slot, before it picked info.Key
+	promoted bool          // reported to OnPromote while Degraded; guarded by root pool's mu
+	addrs    []string      // if not nil, Addr may become any of these (see OpenMulti)
+	idle     time.Duration
+
+	group   string // counted in groups while in tab
+	grouped bool
+
+	ctx    context.Context // canceled by removeConn
+	cancel context.CancelFunc
+}
+
+// newSession opens a session on c with open, or with
+// c.c.NewSession if open is nil. If the session has not opened
+// by deadline, within timeout if that is positive, or before ctx
+// is done, newSession returns an error and closes the session if
+// it opens later. It leaves c.netC's deadline alone, since that
+// would cut off other sessions on c too.
+func (c *conn) newSession(ctx context.Context, deadline time.Time, timeout time.Duration, open func(*ssh.Client) (*ssh.Session, error)) (*ssh.Session, error) {
+	if open == nil {
+		open = (*ssh.Client).NewSession
+	}
+	err := error(os.ErrDeadlineExceeded)
+	if d := time.Now().Add(timeout); timeout > 0 && (deadline.IsZero() || d.Before(deadline)) {
+		deadline, err = d, ErrChannelOpenTimeout
+	}
+	if deadline.IsZero() && ctx.Done() == nil {
+		return open(c.c)
+	}
+	type result struct {
+		s   *ssh.Session
+		err error
+	}
+	done := make(chan result, 1)
+	go func() {
+		s, err := open(c.c)
+		done <- result{s, err}
+	}()
+	var expired <-chan time.Time
+	if !deadline.IsZero() {
+		t := time.NewTimer(time.Until(deadline))
+		defer t.Stop()
+		expired = t.C
+	}
+	select {
+	case r := <-done:
+		return r.s, r.err
+	case <-expired:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+	go func() {
+		if r := <-done; r.s != nil {
+			r.s.Close()
+		}
+	}()
+	return nil, err
+}
+
+// A Session is an SSH session opened by a Pool.
+// Close it when done, so the pool can count
+// the sessions open on each connection.
+type Session struct {
+	*ssh.Session
+	p      *Pool
+	c      *conn
+	opened time.Time
+	once   sync.Once
+}
+
+// Close closes the session and releases its place
+// on the connection.
+func (s *Session) Close() error {
+	err := s.Session.Close()
+	s.once.Do(func() {
+		r := s.p.root()
+		r.mu.Lock()
+		delete(r.opened, s.Session)
+		r.mu.Unlock()
+		s.p.releaseSession(s.c)
+		s.p.releaseLive()
+	})
+	return err
+}
+
+// KeyOf returns the key of the connection, as listed by Keys,
+// that the pool opened session on, if session came from the pool
+// and hasn't been closed.
+func (p *Pool) KeyOf(session *ssh.Session) (string, bool) {
+	r := p.root()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	s, ok := r.opened[session]
+	if !ok {
+		return "", false
+	}
+	return s.c.info.Key, true
+}
+
+// probe sends a keepalive request on c and waits up to d
+// for the server to reply (see KeepAlive and ProbeOnReuse).
+// If it replies, probe records the round trip in c.rtt.
+func (p *Pool) probe(c *conn, d time.Duration) error {
+	done := make(chan error, 1)
+	start := time.Now()
+	go func() {
+		_, _, err := c.c.SendRequest("keepalive@openssh.com", true, nil)
+		done <- err
+	}()
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case err := <-done:
+		if err == nil {
+			r := p.root()
+			r.mu.Lock()
+			c.rtt = time.Since(start)
+			r.mu.Unlock()
+		}
+		return err
+	case <-t.C:
+		return os.ErrDeadlineExceeded
+	}
+}
+
+// snapshot returns c's ConnInfo with its current statistics.
+// The caller must hold the root pool's mu.
+func (c *conn) snapshot() ConnInfo {
+	info := c.info
+	info.KeepAliveRTT = c.rtt
+	info.Health = c.health
+	info.Sessions = c.sessions
+	return info
+}
+
+// ErrChannelOpenTimeout is returned when the server does not
+// accept a new session within ChannelOpenTimeout.
+var ErrChannelOpenTimeout = errors.New("sshpool: timed out opening session channel")
+
+func newConn(info ConnInfo) *conn {
+	c := &conn{ok: make(chan bool), info: info, base: info.Key}
+	c.ctx, c.cancel = context.WithCancel(context.Background())
+	return c
+}
+
+// getConn gets an ssh connection from the pool for info.Key.
+// If none is available, it calls connect to make one,
+// and reports that it did so in dialed.
+// If the pooled connection has expired, it is closed and
+// replaced.
+func (p *Pool) getConn(ctx context.Context, info ConnInfo, connect connectFunc, deadline time.Time) (c *conn, dialed bool) {
+	r := p.root()
+	retried := false
+	var waitStart time.Time // of the first wait for room, if any
+	for {
+		r.mu.Lock()
+		if r.tab == nil {
+			r.tab = make(map[string]*conn)
+		}
+		if r.closed || r.drains[info.Key] {
+			r.mu.Unlock()
+			c = newConn(info)
+			c.err = ErrPoolClosed
+			if !r.closed {
+				c.err = ErrDraining
+			}
+			close(c.ok)
+			return c, false
+		}
+		p.startWorkers()
+		if p.MaxConnsPerKey == 1 && !strings.HasPrefix(info.Role, "dial ") {
+			info.Role = ""
+		}
+		score, _ := ctx.Value(scoreFunc{}).(func(ConnInfo) float64)
+		k, n := p.slot(info.Key, info.Role, score)
+		c, ok := r.tab[k]
+		if ok {
+			c.sessions++
+			c.served++
+			nth := c.served
+			c.lastUsed = time.Now()
+			shared := false
+			select {
+			case <-c.ok:
+				r.stats.ReusedConns++
+			default:
+				r.stats.SharedDials++
+				shared = true
+			}
+			r.mu.Unlock()
+			select {
+			case <-c.ok:
+			case <-ctx.Done():
+				// Leave the dial to its other waiters.
+				p.releaseSession(c)
+				c = newConn(info)
+				c.err = ctx.Err()
+				close(c.ok)
+				return c, false
+			}
+			if shared && p.OnSharedDial != nil {
+				p.OnSharedDial(c.info, c.err)
+			}
+			if c.err != nil && shared && p.SingleFlightRetry && !retried {
+				// The first waiter here to get the lock dials again.
+				retried = true
+				p.removeConn(k, c)
+				continue
+			}
+			if c.err == nil && p.ConnExpired != nil && p.ConnExpired(c.info) {
+				p.removeConn(k, c)
+				p.closeConn(c, "expired")
+				continue
+			}
+			if c.err == nil && p.CheckConn != nil && p.CheckConn(c.c) != nil {
+				p.removeConn(k, c)
+				p.closeConn(c, "check failed")
+				continue
+			}
+			if c.err == nil && !shared && p.ProbeOnReuse > 0 && p.probe(c, p.ProbeOnReuse) != nil {
+				p.removeConn(k, c)
+				p.closeConn(c, "probe failed")
+				continue
+			}
+			if c.err == nil && !p.spend(k, c, nth) {
+				continue
+			}
+			if c.err == nil && p.MaxConnLifetime > 0 && time.Since(c.info.Created) > p.MaxConnLifetime {
+				p.removeConn(k, c)
+				p.retire(c)
+				continue
+			}
+			if c.err == nil {
+				p.logf("reusing connection to %s %s", c.info.Network, c.info.Addr)
+				p.metrics().IncReuse()
+				if p.OnReuse != nil {
+					p.OnReuse(c.info.Network, c.info.Addr)
+				}
+			}
+			return c, false
+		}
+		c = newConn(info)
+		c.info.Key = k
+		c.idle = p.idleTimeout()
+		c.addrs, _ = ctx.Value(multiAddrs{}).([]string)
+		var err error
+		if p.MaxConnsPerKey > 0 && n > p.MaxConnsPerKey {
+			err = errKeyLimit
+		} else if err = p.reserveGroup(c); err == nil && !p.allowDial(info.Key) {
+			p.releaseGroup(c)
+			err = ErrDialRateLimited
+		}
+		if err != nil {
+			if n == 1 {
+				r.mu.Unlock()
+			} else {
+				if waitStart.IsZero() {
+					waitStart = time.Now()
+				}
+				slotDeadline := deadline
+				if p.MaxSlotWait > 0 {
+					slotDeadline = earliest(deadline, waitStart.Add(p.MaxSlotWait))
+				}
+				if err = p.waitFreed(ctx, slotDeadline); err == nil {
+					continue // look again for room on a connection
+				}
+				if errors.Is(err, ErrTimeout) {
+					p.logf("no session slot freed on %s %s in %v; sessions may have been leaked", info.Network, info.Addr, time.Since(waitStart))
+					err = fmt.Errorf("%w: %w", ErrSessionSlotTimeout, unprefixed{err})
+				}
+			}
+			c.err = err
+			close(c.ok)
+			return c, false
+		}
+		c.sessions++
+		c.served++
+		c.lastUsed = time.Now()
+		r.tab[k] = c
+		r.wakeFreed()
+		r.stats.TotalDials++
+		r.mu.Unlock()
+		dialDone, err := p.waitDial(ctx, deadline)
+		if err != nil {
+			c.err = err
+			close(c.ok)
+			return c, false
+		}
+		start := time.Now()
+		c.netC, c.c, c.err = connect(ctx, p.dialDeadline(deadline), &c.info)
+		dialDone()
+		c.info.Created = time.Now()
+		close(c.ok)
+		p.metrics().IncDial()
+		p.metrics().ObserveDialDuration(c.info.Created.Sub(start))
+		if c.err == nil {
+			go p.watch(c)
+			p.spend(k, c, 1)
+		} else {
+			r.mu.Lock()
+			r.stats.DialErrors++
+			r.mu.Unlock()
+		}
+		if c.err == nil && p.MaxIdleConns > 0 {
+			p.evict(p.MaxIdleConns)
+		}
+		if c.err != nil {
+			p.logf("dial %s %s failed: %v", c.info.Network, c.info.Addr, c.err)
+		} else {
+			p.logf("dialed %s %s", c.info.Network, c.info.Addr)
+		}
+		if p.OnDial != nil {
+			p.OnDial(c.info.Network, c.info.Addr, c.err)
+		}
+		return c, true
+	}
+}
+
+// idleTimeout returns the IdleTimeout for a new
+// connection, with IdleJitter applied.
+func (p *Pool) idleTimeout() time.Duration {
+	if p.IdleTimeout <= 0 || p.IdleJitter <= 0 {
+		return p.IdleTimeout
+	}
+	return p.IdleTimeout + rand.N(p.IdleJitter)
+}
+
+// startWorkers starts the background goroutines that
+// IdleTimeout and KeepAlive need, if they aren't running
+// and Bind's context isn't done.
+// The caller must hold the root pool's mu.
+func (p *Pool) startWorkers() {
+	r := p.root()
+	if r.unbound {
+		return
+	}
+	if r.done == nil {
+		r.done = make(chan struct{})
+	}
+	if p.IdleTimeout > 0 && !r.reaper {
+		r.reaper = true
+		go r.reap(p.IdleTimeout/2, r.done)
+	}
+	if p.KeepAlive > 0 && !r.pinger {
+		r.pinger = true
+		go r.keepAlive(p.KeepAlive, r.done)
+	}
+	if p.MaxSessionAge > 0 && !r.sweeper {
+		r.sweeper = true
+		go r.sweep(p.MaxSessionAge, r.done)
+	}
+	if p.HealthCheck > 0 && !r.checker {
+		r.checker = true
+		go r.checkHealth(p.HealthCheck, r.done)
+	}
+}
+
+// waitDial waits for a turn to dial (see MaxDialConcurrency),
+// until deadline or until ctx is done, and returns a func to
+// call when the dial is done. A dial within another dial,
+// as by JumpDial, takes no turn of its own.
+func (p *Pool) waitDial(ctx context.Context, deadline time.Time) (done func(), err error) {
+	if p.MaxDialConcurrency <= 0 || ctx.Value(nestedDial{}) != nil {
+		return func() {}, nil
+	}
+	r := p.root()
+	r.mu.Lock()
+	if r.dialing == nil {
+		r.dialing = make(chan struct{}, p.MaxDialConcurrency)
+	}
+	dialing := r.dialing
+	r.mu.Unlock()
+	var expired <-chan time.Time
+	if !deadline.IsZero() {
+		t := time.NewTimer(time.Until(deadline))
+		defer t.Stop()
+		expired = t.C
+	}
+	select {
+	case dialing <- struct{}{}:
+		return func() { <-dialing }, nil
+	case <-expired:
+		return nil, fmt.Errorf("%w waiting to dial: %w", ErrTimeout, os.ErrDeadlineExceeded)
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// slot returns the key under which to find a connection for
+// key k in role with room for another session (see
+// MaxSessionsPerConn), or to dial one if there is none, and
+// its position n among the connections for k in role. It
+// prefers connections not tagged Degraded (see HealthCheck),
+// passing over them entirely if SkipDegraded is set. If score
+// is not nil, it instead picks the established connection with
+// the lowest score, once there are ConnsPerKey of them (see
+// OpenScored). The caller must hold the root pool's mu.
+func (p *Pool) slot(k, role string, score func(ConnInfo) float64) (sk string, n int) {
+	r := p.root()
+	key := func(n int) string {
+		if role != "" {
+			return roleKey(k, role, n)
+		}
+		return slotKey(k, n)
+	}
+	per := p.ConnsPerKey
+	if p.MaxConnsPerKey > 0 && per > p.MaxConnsPerKey {
+		per = p.MaxConnsPerKey
+	}
+	if _, ok := r.tab[k]; role == "" && !ok {
+		return k, 1
+	}
+	if score != nil {
+		for m := 2; role == "" && m <= per; m++ {
+			if _, ok := r.tab[slotKey(k, m)]; !ok {
+				return slotKey(k, m), m
+			}
+		}
+		low := 0.0
+		for m := 1; ; m++ {
+			c, ok := r.tab[key(m)]
+			if !ok {
+				break
+			}
+			select {
+			case <-c.ok:
+			default:
+				continue // still dialing
+			}
+			if c.err != nil || !p.usable(c) {
+				continue
+			}
+			if s := score(c.snapshot()); n == 0 || s < low {
+				n, low = m, s
+			}
+		}
+		if n > 0 {
+			return key(n), n
+		}
+	}
+	if role == "" && per > 1 {
+		turn := r.turn
+		r.turn++
+		least, degraded := 0, false
+		for i := 0; i < per; i++ {
+			m := (turn+i)%per + 1
+			c, ok := r.tab[slotKey(k, m)]
+			if !ok {
+				return slotKey(k, m), m
+			}
+			if !p.usable(c) {
+				continue
+			}
+			d := c.health == Degraded
+			if n == 0 || degraded && !d || d == degraded && c.sessions < least {
+				n, least, degraded = m, c.sessions, d
+			}
+		}
+		if n > 0 {
+			return slotKey(k, n), n
+		}
+	}
+	fallback := 0 // first degraded connection with room
+	for n = 1; ; n++ {
+		c, ok := r.tab[key(n)]
+		if !ok {
+			if fallback > 0 {
+				return key(fallback), fallback
+			}
+			return key(n), n
+		}
+		if !p.usable(c) {
+			continue
+		}
+		if c.health != Degraded {
+			return key(n), n
+		}
+		if fallback == 0 {
+			fallback = n
+		}
+	}
+}
+
+// usable reports whether Open may start a session on c: it has
+// room (see MaxSessionsPerConn), and it isn't Degraded if
+// SkipDegraded is set. The caller must hold the root pool's mu.
+func (p *Pool) usable(c *conn) bool {
+	return !c.full(p.MaxSessionsPerConn) && !(p.SkipDegraded && c.health == Degraded)
+}
+
+// slotKey returns the key of the nth connection for key k.
+func slotKey(k string, n int) string {
+	if n == 1 {
+		return k
+	}
+	return k + " #" + strconv.Itoa(n)
+}
+
+// roleKey returns the key of the nth connection for key k in
+// role. Like slotKey's, it has the prefix k+" #", so keyConns
+// finds it.
+func roleKey(k, role string, n int) string {
+	k += " #" + role
+	if n == 1 {
+		return k
+	}
+	return k + " " + strconv.Itoa(n)
+}
+
+// full reports whether c has room for no more sessions, given
+// a limit of max per connection (none if zero) and any limit
+// learned from the server. The caller must hold the root pool's mu.
+func (c *conn) full(max int) bool {
+	if c.limit > 0 && (max <= 0 || c.limit < max) {
+		max = c.limit
+	}
+	return max > 0 && c.sessions >= max
+}
+
+// limitSessions records that the server refused a session on c,
+// after the caller released its place, so that Open looks
+// elsewhere for room until a session on c closes. It reports
+// false if c has no sessions open, in which case the refusal
+// is not about a limit.
+func (p *Pool) limitSessions(c *conn) bool {
+	r := p.root()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if c.sessions <= 0 {
+		return false
+	}
+	c.limit = c.sessions
+	return true
+}
+
+// ErrSessionSlotTimeout matches errors from Open caused by
+// waiting too long (see Timeout and MaxSlotWait) for room on
+// a server's connections when they are all full and no more
+// can be dialed. Such errors also match ErrTimeout.
+var ErrSessionSlotTimeout = errors.New("sshpool: all session slots in use")
+
+// errKeyLimit means MaxConnsPerKey connections are open.
+// getConn waits rather than returning it.
+var errKeyLimit = errors.New("sshpool: connection limit for key reached")
+
+// waitFreed unlocks the root pool's mu, which the caller must
+// hold, and waits for a session or connection to go away.
+func (p *Pool) waitFreed(ctx context.Context, deadline time.Time) error {
+	r := p.root()
+	if r.freed == nil {
+		r.freed = make(chan struct{})
+	}
+	freed := r.freed
+	r.mu.Unlock()
+	var expired <-chan time.Time
+	if !deadline.IsZero() {
+		t := time.NewTimer(time.Until(deadline))
+		defer t.Stop()
+		expired = t.C
+	}
+	select {
+	case <-freed:
+		return nil
+	case <-expired:
+		return fmt.Errorf("%w waiting for a free connection: %w", ErrTimeout, os.ErrDeadlineExceeded)
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// ErrMaxSessions is returned by Open when MaxSessions
+// sessions are open and StrictMaxSessions is set.
+var ErrMaxSessions = errors.New("sshpool: too many sessions open")
+
+// takeSession counts a new Session toward MaxSessions,
+// waiting for room until deadline or until ctx is done.
+func (p *Pool) takeSession(ctx context.Context, deadline time.Time) error {
+	r := p.root()
+	for {
+		r.mu.Lock()
+		if p.MaxSessions <= 0 || r.live < p.MaxSessions {
+			r.live++
+			r.mu.Unlock()
+			return nil
+		}
+		if p.StrictMaxSessions {
+			r.mu.Unlock()
+			return ErrMaxSessions
+		}
+		if err := p.waitFreed(ctx, deadline); err != nil {
+			return err
+		}
+	}
+}
+
+// releaseLive uncounts a Session counted by takeSession.
+func (p *Pool) releaseLive() {
+	r := p.root()
+	r.mu.Lock()
+	r.live--
+	r.wakeFreed()
+	r.mu.Unlock()
+}
+
+// releaseSession gives up a place on c counted by getConn.
+func (p *Pool) releaseSession(c *conn) {
+	r := p.root()
+	r.mu.Lock()
+	c.sessions--
+	c.lastUsed = time.Now()
+	done := c.retired && c.sessions == 0
+	idle := false
+	if p.CloseOnIdle && c.sessions == 0 && r.tab[c.info.Key] == c {
+		// Under mu, no Open can be about to reuse c.
+		delete(r.tab, c.info.Key)
+		p.releaseGroup(c)
+		idle = true
+	}
+	r.wakeFreed()
+	r.mu.Unlock()
+	if done {
+		p.closeConn(c, "retired")
+	} else if idle {
+		c.cancel()
+		p.closeConn(c, "idle")
+	}
+}
+
+// spend counts the caller's place on c, the nth taken, toward
+// MaxSessionsPerConnLifetime. If it is the last place c may
+// serve, spend retires c, leaving the caller's place. If c had
+// no places left, spend retires it, gives up the caller's place,
+// and reports false.
+func (p *Pool) spend(k string, c *conn, nth int) bool {
+	max := p.MaxSessionsPerConnLifetime
+	if max <= 0 || nth < max {
+		return true
+	}
+	p.removeConn(k, c)
+	if nth > max {
+		p.retire(c)
+		return false
+	}
+	r := p.root()
+	r.mu.Lock()
+	c.retired = true
+	r.mu.Unlock()
+	return true
+}
+
+// retire gives up the caller's place on c, which must already
+// be removed from the pool, and arranges for c to be closed
+// when its last session closes.
+func (p *Pool) retire(c *conn) {
+	r := p.root()
+	r.mu.Lock()
+	c.retired = true
+	r.mu.Unlock()
+	p.releaseSession(c)
+}
+
+// keepAlive checks the pool's connections every interval d
+// (see KeepAlive) until stop is closed.
+func (p *Pool) keepAlive(d time.Duration, stop chan struct{}) {
+	r := p.root()
+	t := time.NewTicker(d)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+		case <-stop:
+			return
+		}
+		var conns []*conn
+		r.mu.Lock()
+		for _, c := range r.tab {
+			select {
+			case <-c.ok:
+				if c.err == nil {
+					conns = append(conns, c)
+				}
+			default: // still dialing
+			}
+		}
+		r.mu.Unlock()
+		for _, c := range conns {
+			if r.probe(c, d) == nil {
+				continue
+			}
+			r.removeConn(c.info.Key, c)
+			r.closeConn(c, "keepalive failed")
+		}
+	}
+}
+
+// checkHealth opens and closes a session on each connection
+// (see HealthCheck) every interval d until stop is closed.
+func (p *Pool) checkHealth(d time.Duration, stop chan struct{}) {
+	r := p.root()
+	t := time.NewTicker(d)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+		case <-stop:
+			return
+		}
+		var conns []*conn
+		r.mu.Lock()
+		for _, c := range r.tab {
+			select {
+			case <-c.ok:
+				if c.err == nil && !c.full(p.MaxSessionsPerConn) {
+					c.sessions++ // the check's session
+					conns = append(conns, c)
+				}
+			default: // still dialing
+			}
+		}
+		r.mu.Unlock()
+		for _, c := range conns {
+			h := Healthy
+			s, err := c.newSession(c.ctx, time.Time{}, d, p.NewSession)
+			var oce *ssh.OpenChannelError
+			if err == nil {
+				s.Close()
+			} else if c.ctx.Err() != nil {
+				p.releaseSession(c) // removed from the pool meanwhile
+				continue
+			} else if errors.As(err, &oce) {
+				h = Degraded
+			} else {
+				h = Dead
+			}
+			r.mu.Lock()
+			var to *conn
+			if h == Degraded && !c.promoted {
+				to = p.promotion(c)
+			}
+			c.health = h
+			c.promoted = to != nil || h == Degraded && c.promoted
+			r.mu.Unlock()
+			p.releaseSession(c)
+			if to != nil && p.OnPromote != nil {
+				p.OnPromote(c.info, to.info)
+			}
+			if h == Dead {
+				p.removeConn(c.info.Key, c)
+				p.closeConn(c, "health check failed")
+			}
+		}
+	}
+}
+
+// promotion returns the healthy connection Open will prefer
+// to c, the first for its server and role, once c is Degraded,
+// or nil if c isn't the first or there is none.
+// The caller must hold the root pool's mu.
+func (p *Pool) promotion(c *conn) *conn {
+	r := p.root()
+	first := slotKey(c.base, 1)
+	if c.info.Role != "" {
+		first = roleKey(c.base, c.info.Role, 1)
+	}
+	if c.info.Key != first {
+		return nil
+	}
+	var to *conn
+	for _, c1 := range r.keyConns(c.base) {
+		if c1 == c || c1.info.Role != c.info.Role || c1.health != Healthy {
+			continue
+		}
+		select {
+		case <-c1.ok:
+			if c1.err == nil && (to == nil || c1.info.Key < to.info.Key) {
+				to = c1
+			}
+		default: // still dialing
+		}
+	}
+	return to
+}
+
+// reap closes idle connections (see IdleTimeout) every
+// interval d until stop is closed.
+func (p *Pool) reap(d time.Duration, stop chan struct{}) {
+	r := p.root()
+	t := time.NewTicker(d)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+		case <-stop:
+			return
+		}
+		now := time.Now()
+		var idle []*conn
+		r.mu.Lock()
+		for k, c := range r.tab {
+			select {
+			case <-c.ok:
+			default:
+				continue // still dialing
+			}
+			if c.err == nil && c.idle > 0 && c.sessions == 0 && now.Sub(c.lastUsed) > c.idle {
+				delete(r.tab, k)
+				r.releaseGroup(c)
+				c.cancel()
+				idle = append(idle, c)
+			}
+		}
+		if len(idle) > 0 {
+			r.wakeFreed()
+		}
+		r.mu.Unlock()
+		for _, c := range idle {
+			r.closeConn(c, "idle")
+		}
+	}
+}
+
+// sweep closes sessions open longer than d (see MaxSessionAge),
+// checking every d/2 until stop is closed.
+func (p *Pool) sweep(d time.Duration, stop chan struct{}) {
+	r := p.root()
+	t := time.NewTicker(d / 2)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+		case <-stop:
+			return
+		}
+		now := time.Now()
+		var old []*Session
+		r.mu.Lock()
+		for _, s := range r.opened {
+			if now.Sub(s.opened) > d {
+				old = append(old, s)
+			}
+		}
+		r.mu.Unlock()
+		for _, s := range old {
+			s.Close()
+			r.logf("closed session on %s %s open longer than %v", s.c.info.Network, s.c.info.Addr, d)
+			if r.OnSessionTimeout != nil {
+				r.OnSessionTimeout(s.c.info.Network, s.c.info.Addr)
+			}
+		}
+	}
+}
+
+// evict closes least recently used connections with no open
+// sessions until the pool holds at most max connections
+// (see MaxIdleConns).
+func (p *Pool) evict(max int) {
+	r := p.root()
+	var lru []*conn
+	r.mu.Lock()
+	for len(r.tab) > max {
+		var (
+			k0 string
+			c0 *conn
+		)
+		for k, c := range r.tab {
+			select {
+			case <-c.ok:
+			default:
+				continue // still dialing
+			}
+			if c.err == nil && c.sessions == 0 && (c0 == nil || c.lastUsed.Before(c0.lastUsed)) {
+				k0, c0 = k, c
+			}
+		}
+		if c0 == nil {
+			break
+		}
+		delete(r.tab, k0)
+		r.releaseGroup(c0)
+		c0.cancel()
+		lru = append(lru, c0)
+	}
+	if len(lru) > 0 {
+		r.wakeFreed()
+	}
+	r.mu.Unlock()
+	for _, c := range lru {
+		p.closeConn(c, "evicted")
+	}
+}
+
+// watch waits for c's transport to close and removes c from the
+// pool if it is still there, as when the server has restarted,
+// so that Open doesn't find it dead later. It returns once c is
+// closed, however that happens.
+func (p *Pool) watch(c *conn) {
+	c.c.Wait()
+	r := p.root()
+	r.mu.Lock()
+	cur, ok := r.tab[c.info.Key]
+	if ok && cur == c {
+		delete(r.tab, c.info.Key)
+		r.releaseGroup(c)
+		r.wakeFreed()
+	}
+	r.mu.Unlock()
+	if ok && cur == c {
+		c.cancel()
+		p.closeConn(c, "disconnected")
+	}
+}
+
+// wakeFreed wakes callers in waitFreed.
+// The caller must hold the root pool's mu.
+func (p *Pool) wakeFreed() {
+	r := p.root()
+	if r.freed != nil {
+		close(r.freed)
+		r.freed = nil
+	}
+}
+
+// reserveGroup counts c against its group's MaxConnsPerGroup,
+// or returns ErrGroupLimit if the group is full.
+// The root pool's mu must be held.
+func (p *Pool) reserveGroup(c *conn) error {
+	if p.GroupFunc == nil || p.MaxConnsPerGroup <= 0 {
+		return nil
+	}
+	r := p.root()
+	g := p.GroupFunc(c.info.Network, c.info.Addr)
+	if r.groups[g] >= p.MaxConnsPerGroup {
+		return ErrGroupLimit
+	}
+	if r.groups == nil {
+		r.groups = make(map[string]int)
+	}
+	r.groups[g]++
+	c.group, c.grouped = g, true
+	return nil
+}
+
+// releaseGroup undoes reserveGroup.
+// The root pool's mu must be held.
+func (p *Pool) releaseGroup(c *conn) {
+	if !c.grouped {
+		return
+	}
+	r := p.root()
+	if r.groups[c.group]--; r.groups[c.group] <= 0 {
+		delete(r.groups, c.group)
+	}
+	c.grouped = false
+}
+
+// allowDial reports whether DialRate allows a new dial for k,
+// and if so, counts it. The root pool's mu must be held.
+func (p *Pool) allowDial(k string) bool {
+	if p.DialRate <= 0 {
+		return true
+	}
+	r := p.root()
+	if r.limits == nil {
+		r.limits = make(map[string]*bucket)
+		r.lru = list.New()
+	}
+	burst := float64(p.DialBurst)
+	if burst < 1 {
+		burst = 1
+	}
+	now := time.Now()
+	b, ok := r.limits[k]
+	if ok {
+		r.lru.MoveToFront(b.elem)
+	} else {
+		b = &bucket{tokens: burst, last: now, elem: r.lru.PushFront(k)}
+		r.limits[k] = b
+	}
+	for p.MaxTrackedKeys > 0 && r.lru.Len() > p.MaxTrackedKeys {
+		delete(r.limits, r.lru.Remove(r.lru.Back()).(string))
+	}
+	return b.take(now, p.DialRate, burst)
+}
+
+// paceSession waits until SessionRate allows a new session
+// on c, or returns an error if that would be after deadline.
+func (p *Pool) paceSession(ctx context.Context, c *conn, deadline time.Time) error {
+	if p.SessionRate <= 0 {
+		return nil
+	}
+	burst := float64(p.SessionBurst)
+	if burst < 1 {
+		burst = 1
+	}
+	r := p.root()
+	now := time.Now()
+	r.mu.Lock()
+	if c.pace == nil {
+		c.pace = &bucket{tokens: burst, last: now}
+	}
+	wait := c.pace.reserve(now, p.SessionRate, burst)
+	if !deadline.IsZero() && now.Add(wait).After(deadline) {
+		c.pace.tokens++ // give back our turn
+		wait = -1
+	}
+	r.mu.Unlock()
+	if wait < 0 {
+		return fmt.Errorf("%w waiting for session rate limit: %w", ErrTimeout, os.ErrDeadlineExceeded)
+	}
+	return sleep(ctx, wait)
+}
+
+// dialDeadline returns the deadline for a dial
+// starting now, given the deadline for Open.
+func (p *Pool) dialDeadline(deadline time.Time) time.Time {
+	if p.DialTimeout <= 0 {
+		return deadline
+	}
+	return earliest(deadline, time.Now().Add(p.DialTimeout))
+}
+
+// earliest returns the earlier of deadline and t,
+// where a zero deadline means none.
+func earliest(deadline, t time.Time) time.Time {
+	if deadline.IsZero() || t.Before(deadline) {
+		return t
+	}
+	return deadline
+}
+
+// ctxErr is like ctx.Err, but also reports a deadline that has
+// passed before ctx's own timer has noticed.
+func ctxErr(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if d, ok := ctx.Deadline(); ok && !time.Now().Before(d) {
+		return context.DeadlineExceeded
+	}
+	return nil
+}
+
+// sleep pauses for d or until ctx is done,
+// returning ctx.Err() in the latter case.
+func sleep(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// A bucket is a token bucket rate limiter.
+type bucket struct {
+	tokens float64
+	last   time.Time
+	elem   *list.Element // in Pool.lru, for keyed buckets
+}
+
+// refill adds tokens to b at rate per second, up to burst.
+func (b *bucket) refill(now time.Time, rate, burst float64) {
+	b.tokens += now.Sub(b.last).Seconds() * rate
+	if b.tokens > burst {
+		b.tokens = burst
+	}
+	b.last = now
+}
+
+// take takes one token from b if there is one.
+func (b *bucket) take(now time.Time, rate, burst float64) bool {
+	b.refill(now, rate, burst)
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// reserve takes one token from b, going into debt if there
+// is none, and returns how long to wait before using it.
+func (b *bucket) reserve(now time.Time, rate, burst float64) time.Duration {
+	b.refill(now, rate, burst)
+	b.tokens--
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / rate * float64(time.Second))
+}
+
+// CloseAddr closes and removes every pooled connection to the
+// given server, whatever user or config it was opened with,
+// and reports how many it closed. Sessions on those
+// connections are ended.
+func (p *Pool) CloseAddr(network, addr string) int {
+	r := p.root()
+	var conns []*conn
+	r.mu.Lock()
+	for _, c := range r.tab {
+		if c.info.Network == network && c.mayHaveAddr(addr) {
+			conns = append(conns, c)
+		}
+	}
+	r.mu.Unlock()
+	n := 0
+	for _, c := range conns {
+		<-c.ok // c.info is final once dialed
+		if c.err != nil || c.info.Network != network || c.info.Addr != addr {
+			continue
+		}
+		p.removeConn(c.info.Key, c)
+		p.closeConn(c, "CloseAddr")
+		n++
+	}
+	return n
+}
+
+// mayHaveAddr reports whether c's Addr is or may become addr,
+// without waiting for c's dial. The caller must hold the root
+// pool's mu.
+func (c *conn) mayHaveAddr(addr string) bool {
+	select {
+	case <-c.ok:
+		return c.info.Addr == addr
+	default: // still dialing
+	}
+	if c.addrs == nil {
+		return c.info.Addr == addr // set before the dial
+	}
+	for _, a := range c.addrs {
+		if a == addr {
+			return true
+		}
+	}
+	return false
+}
+
+// Close closes all of the pool's connections, waiting for
+// dials in progress to finish first, and makes further opens
+// fail with ErrPoolClosed. It returns the first error from
+// closing a connection. If p is a subpool, Close closes the
+// whole pool; see Sub.
+func (p *Pool) Close() error {
+	var err error
+	for _, c := range p.shut() {
+		if err1 := p.closePooled(c); err == nil {
+			err = err1
+		}
+	}
+	return err
+}
+
+// CloseTimeout is like Close, but closes the connections
+// concurrently and gives up after d, so a dial or transport
+// that hangs can't hold up shutdown. If some connections
+// haven't closed by then, it returns an error matching
+// ErrTimeout that lists them; they go on closing in the
+// background.
+func (p *Pool) CloseTimeout(d time.Duration) error {
+	conns := p.shut()
+	type result struct {
+		c   *conn
+		err error
+	}
+	results := make(chan result, len(conns))
+	for _, c := range conns {
+		go func() { results <- result{c, p.closePooled(c)} }()
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	var err error
+	closed := make(map[*conn]bool)
+	for len(closed) < len(conns) {
+		select {
+		case r := <-results:
+			closed[r.c] = true
+			if err == nil {
+				err = r.err
+			}
+		case <-t.C:
+			var stuck []string
+			for _, c := range conns {
+				if !closed[c] {
+					stuck = append(stuck, c.info.Network+" "+c.info.Addr)
+				}
+			}
+			sort.Strings(stuck)
+			return fmt.Errorf("%w closing connections: %s", ErrTimeout, strings.Join(stuck, ", "))
+		}
+	}
+	return err
+}
+
+// shut makes further opens fail with ErrPoolClosed, stops
+// the background goroutines, and returns the connections
+// in the pool for the caller to close.
+func (p *Pool) shut() []*conn {
+	r := p.root()
+	var conns []*conn
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.closed = true
+	if r.done != nil {
+		close(r.done)
+		r.done = nil
+	}
+	for _, c := range r.tab {
+		conns = append(conns, c)
+	}
+	return conns
+}
+
+// closePooled waits for c's dial to finish,
+// then removes c from the pool and closes it.
+func (p *Pool) closePooled(c *conn) error {
+	<-c.ok
+	p.removeConn(c.info.Key, c)
+	if c.err != nil {
+		return nil
+	}
+	return p.closeConn(c, "pool closed")
+}
+
+// Drain is like Close, but lets open sessions finish: it makes
+// further opens fail with ErrPoolClosed, waits for the sessions
+// open on the pool's connections to close, then closes the
+// connections. If ctx is done first, Drain closes the connections
+// anyway and returns ctx.Err().
+func (p *Pool) Drain(ctx context.Context) error {
+	r := p.root()
+	var conns []*conn
+	r.mu.Lock()
+	r.closed = true
+	for _, c := range r.tab {
+		conns = append(conns, c)
+	}
+	r.mu.Unlock()
+	var err error
+	for _, c := range conns {
+		<-c.ok
+		for err == nil {
+			r.mu.Lock()
+			if c.sessions <= 0 {
+				r.mu.Unlock()
+				break
+			}
+			err = p.waitFreed(ctx, time.Time{})
+		}
+	}
+	if err1 := p.Close(); err == nil {
+		err = err1
+	}
+	return err
+}
+
+// Bind ties the pool's background goroutines, such as the
+// ones IdleTimeout and KeepAlive start, to ctx: once ctx is
+// done they stop, and they aren't started again. Connections
+// stay usable, but are no longer reaped or checked. If
+// BindDrain is set, the pool is then drained as by Drain,
+// letting open sessions finish. Bind doesn't block.
+func (p *Pool) Bind(ctx context.Context) {
+	r := p.root()
+	context.AfterFunc(ctx, func() {
+		r.mu.Lock()
+		r.unbound = true
+		if r.done != nil {
+			close(r.done)
+			r.done = nil
+		}
+		r.mu.Unlock()
+		if p.BindDrain {
+			p.Drain(context.Background())
+		}
+	})
+}
+
+// ErrPoolClosed is returned by Open and its variants
+// after Close has been called.
+var ErrPoolClosed = errors.New("sshpool: pool is closed")
+
+// DrainKey takes the given server out of service: it makes
+// opens for it fail with ErrDraining, waits for the sessions
+// open on its connections to close, then closes the connections.
+// If ctx is done first, DrainKey closes the connections anyway
+// and returns ctx.Err(). Once DrainKey returns, the server can
+// be opened again.
+func (p *Pool) DrainKey(ctx context.Context, network, addr string, config *ssh.ClientConfig) error {
+	k := p.key(network, addr, config)
+	r := p.root()
+	r.mu.Lock()
+	if r.drains == nil {
+		r.drains = make(map[string]bool)
+	}
+	r.drains[k] = true
+	conns := r.keyConns(k)
+	r.mu.Unlock()
+	defer func() {
+		r.mu.Lock()
+		delete(r.drains, k)
+		r.mu.Unlock()
+	}()
+	var err error
+	for _, c := range conns {
+		<-c.ok
+		for err == nil {
+			r.mu.Lock()
+			if c.sessions <= 0 {
+				r.mu.Unlock()
+				break
+			}
+			err = p.waitFreed(ctx, time.Time{})
+		}
+		p.removeConn(c.info.Key, c)
+		if c.err == nil {
+			p.closeConn(c, "drained")
+		}
+	}
+	return err
+}
+
+// CloseConn closes the pool's connections to the given server,
+// ending any sessions open on them, so the next Open dials afresh.
+// It returns the first error from closing a connection. To let
+// open sessions finish first, use DrainKey instead.
+func (p *Pool) CloseConn(network, addr string, config *ssh.ClientConfig) error {
+	r := p.root()
+	r.mu.Lock()
+	conns := r.keyConns(p.key(network, addr, config))
+	r.mu.Unlock()
+	var err error
+	for _, c := range conns {
+		<-c.ok
+		p.removeConn(c.info.Key, c)
+		if c.err != nil {
+			continue
+		}
+		if err1 := p.closeConn(c, "CloseConn"); err == nil {
+			err = err1
+		}
+	}
+	return err
+}
+
+// readyConn returns an established connection for key k,
+// preferring the first (see slotKey), or nil if there is none.
+// The caller must hold the root pool's mu.
+func (p *Pool) readyConn(k string) *conn {
+	r := p.root()
+	conns := r.keyConns(k)
+	sort.Slice(conns, func(i, j int) bool { return conns[i].info.Key < conns[j].info.Key })
+	for _, c := range conns {
+		select {
+		case <-c.ok:
+			if c.err == nil {
+				return c
+			}
+		default: // still dialing
+		}
+	}
+	return nil
+}
+
+// keyConns returns the connections for key k, including any
+// extra ones opened for MaxSessionsPerConn or reserved for a
+// role (see OpenControl). The caller must hold the root pool's mu.
+func (p *Pool) keyConns(k string) []*conn {
+	r := p.root()
+	var conns []*conn
+	for k1, c := range r.tab {
+		if k1 == k || strings.HasPrefix(k1, k+" #") {
+			conns = append(conns, c)
+		}
+	}
+	return conns
+}
+
+// ErrDraining is returned by Open and its variants
+// for a server that DrainKey is draining.
+var ErrDraining = errors.New("sshpool: server is draining")
+
+// closeConn closes c, which must already be out of the pool,
+// and reports it to OnClose.
+func (p *Pool) closeConn(c *conn, reason string) error {
+	err := c.c.Close()
+	p.logf("closed connection to %s %s: %s", c.info.Network, c.info.Addr, reason)
+	if p.OnClose != nil {
+		p.OnClose(c.info.Network, c.info.Addr, reason)
+	}
+	return err
+}
+
+// logf reports an event to Logf, if set.
+func (p *Pool) logf(format string, args ...interface{}) {
+	if p.Logf != nil {
+		p.Logf("sshpool: "+format, args...)
+	}
+}
+
+// removeConn removes c1 from the pool if present
+// and cancels its context.
+func (p *Pool) removeConn(k string, c1 *conn) {
+	r := p.root()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	c, ok := r.tab[k]
+	if ok && c == c1 {
+		delete(r.tab, k)
+		p.releaseGroup(c1)
+		r.wakeFreed()
+	}
+	c1.cancel()
+}
+
+func (p *Pool) dial(ctx context.Context, network, addr string, config *ssh.ClientConfig, deadline time.Time, info *ConnInfo) (net.Conn, *ssh.Client, error) {
+	config, err := p.hookConfig(network, addr, config)
+	if err != nil {
+		return nil, nil, err
+	}
+	r := p.root()
+	r.mu.Lock()
+	dial := p.Dial // see SetDial
+	r.mu.Unlock()
+	builtin := dial == nil && p.DialContext == nil
+	if p.DialContext != nil {
+		dial = func(network, addr string) (net.Conn, error) {
+			return p.DialContext(ctx, network, addr)
+		}
+	}
+	if dial == nil {
+		dialer := p.dialer(deadline)
+		dial = func(network, addr string) (net.Conn, error) {
+			return dialer.DialContext(ctx, network, addr)
+		}
+	}
+	for i := len(p.middleware) - 1; i >= 0; i-- {
+		dial = p.middleware[i](dial)
+	}
+	start := time.Now()
+	netC, err := dial(network, addr)
+	info.ConnectDuration = time.Since(start)
+	if err != nil {
+		return nil, nil, &DialError{network, addr, err}
+	}
+	if err := ctx.Err(); err != nil {
+		// Dial can't be interrupted, but we needn't wait for it.
+		netC.Close()
+		return nil, nil, err
+	}
+	if builtin {
+		opts := p.SockOpts
+		if opts == nil {
+			opts = &DefaultSockOpts
+		}
+		if err := opts.apply(netC); err != nil {
+			netC.Close()
+			return nil, nil, err
+		}
+	}
+	if p.AfterDial != nil {
+		if err := p.AfterDial(netC); err != nil {
+			netC.Close()
+			return nil, nil, err
+		}
+	}
+	netC, sshC, err := handshake(ctx, netC, addr, config, deadline, info)
+	if err == nil {
+		err = p.checkAlgorithms(sshC, info.Algorithms)
+	}
+	if err != nil && ctx.Err() == nil {
+		err = &DialError{network, addr, err}
+	}
+	return netC, sshC, err
+}
+
+// An AlgorithmPolicy lists algorithms that connections
+// must not negotiate (see Pool.MinAlgorithms).
+type AlgorithmPolicy struct {
+	KeyExchanges []string
+	HostKeys     []string
+	Ciphers      []string
+	MACs         []string
+}
+
+// ErrWeakAlgorithm matches errors from dials that negotiated
+// an algorithm MinAlgorithms disallows.
+var ErrWeakAlgorithm = errors.New("sshpool: weak algorithm negotiated")
+
+// checkAlgorithms closes c and returns an error if algs
+// includes one MinAlgorithms disallows.
+func (p *Pool) checkAlgorithms(c *ssh.Client, algs ssh.NegotiatedAlgorithms) error {
+	m := p.MinAlgorithms
+	if m == nil {
+		return nil
+	}
+	for _, check := range []struct {
+		kind, alg  string
+		disallowed []string
+	}{
+		{"key exchange", algs.KeyExchange, m.KeyExchanges},
+		{"host key", algs.HostKey, m.HostKeys},
+		{"cipher", algs.Read.Cipher, m.Ciphers},
+		{"cipher", algs.Write.Cipher, m.Ciphers},
+		{"MAC", algs.Read.MAC, m.MACs},
+		{"MAC", algs.Write.MAC, m.MACs},
+	} {
+		for _, alg := range check.disallowed {
+			if check.alg == alg {
+				c.Close()
+				return fmt.Errorf("%w: %s %s", ErrWeakAlgorithm, check.kind, alg)
+			}
+		}
+	}
+	return nil
+}
+
+// dialer returns the built-in dialer, used when Dial and
+// DialContext are nil.
+func (p *Pool) dialer(deadline time.Time) *net.Dialer {
+	d := &net.Dialer{Deadline: deadline}
+	if p.DisableHappyEyeballs {
+		d.FallbackDelay = -1
+	}
+	if testHookDialer != nil {
+		testHookDialer(d)
+	}
+	return d
+}
+
+// testHookDialer, if not nil, is called with each dialer
+// the pool makes, so tests can fake name lookups and connects.
+var testHookDialer func(*net.Dialer)
+
+// hookConfig returns the config to use for a new connection,
+// after applying ConfigHook and checkConfig.
+func (p *Pool) hookConfig(network, addr string, config *ssh.ClientConfig) (*ssh.ClientConfig, error) {
+	if p.ConfigHook != nil {
+		c := *config
+		c.Auth = append([]ssh.AuthMethod(nil), config.Auth...)
+		var err error
+		config, err = p.ConfigHook(network, addr, &c)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return config, p.checkConfig(config)
+}
+
+// ErrNoAuth is returned when StrictConfig is set and
+// a config has no authentication methods.
+var ErrNoAuth = errors.New("sshpool: config has no authentication methods")
+
+// checkConfig catches configs that cannot work,
+// before a connection is made for them.
+func (p *Pool) checkConfig(config *ssh.ClientConfig) error {
+	if p.StrictConfig && len(config.Auth) == 0 {
+		return ErrNoAuth
+	}
+	return nil
+}
+
+// SockOpts are socket options for TCP connections.
+type SockOpts struct {
+	NoDelay    bool // disable Nagle's algorithm (TCP_NODELAY)
+	SendBuffer int  // SO_SNDBUF size in bytes, if nonzero
+	RecvBuffer int  // SO_RCVBUF size in bytes, if nonzero
+}
+
+// DefaultSockOpts favor latency, as interactive SSH does.
+var DefaultSockOpts = SockOpts{NoDelay: true}
+
+// apply sets o on c, if c is a TCP connection.
+func (o *SockOpts) apply(c net.Conn) error {
+	tc, ok := c.(*net.TCPConn)
+	if !ok {
+		return nil
+	}
+	if err := tc.SetNoDelay(o.NoDelay); err != nil {
+		return err
+	}
+	if o.SendBuffer > 0 {
+		if err := tc.SetWriteBuffer(o.SendBuffer); err != nil {
+			return err
+		}
+	}
+	if o.RecvBuffer > 0 {
+		if err := tc.SetReadBuffer(o.RecvBuffer); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// handshake starts an SSH client connection over netC,
+// closing netC if that fails or deadline passes first.
+func handshake(ctx context.Context, netC net.Conn, addr string, config *ssh.ClientConfig, deadline time.Time, info *ConnInfo) (net.Conn, *ssh.Client, error) {
+	if !deadline.IsZero() {
+		netC.SetDeadline(deadline)
+	}
+	stop := context.AfterFunc(ctx, func() {
+		netC.SetDeadline(time.Unix(1, 0)) // interrupt the handshake
+	})
+	start := time.Now()
+	sshConn, chans, reqs, err := ssh.NewClientConn(netC, addr, config)
+	info.HandshakeDuration = time.Since(start)
+	if !stop() {
+		if sshConn != nil {
+			sshConn.Close()
+		}
+		netC.Close()
+		return nil, nil, ctx.Err()
+	}
+	if err != nil {
+		netC.Close()
+		return nil, nil, err
+	}
+	if !deadline.IsZero() {
+		netC.SetDeadline(time.Time{})
+	}
+	info.Algorithms = algorithms(sshConn)
+	return netC, ssh.NewClient(sshConn, chans, reqs), nil
+}
+
+// algorithms returns the algorithms negotiated for c,
+// if its ssh package reports them.
+func algorithms(c ssh.Conn) ssh.NegotiatedAlgorithms {
+	if m, ok := c.(ssh.AlgorithmsConnMetadata); ok {
+		return m.Algorithms()
+	}
+	return ssh.NegotiatedAlgorithms{}
+}
+
+func (p *Pool) key(net, addr string, config *ssh.ClientConfig) string {
+	key := p.Key
+	if key == nil {
+		key = AddrUserKey
+	}
+	return key(net, addr, config)
+}
+
+// Returns a distinct string for any unique combination of net,
+// addr, and config.User.
+func AddrUserKey(net, addr string, config *ssh.ClientConfig) string {
+	return strconv.Quote(net) + " " + strconv.Quote(addr) + " " + strconv.Quote(config.User)
+}
+
+// AddrUserHostKey is like AddrUserKey, but also distinguishes
+// configs by identity, so a connection whose host key was verified
+// under one HostKeyCallback is not reused under another. Callbacks
+// can't be inspected or compared, so the config stands in for its
+// callback: callers sharing a *ssh.ClientConfig share connections,
+// but two configs made separately get connections of their own
+// even if they accept the same keys. A config that is garbage
+// collected never passes its identity on to a later config. Use it
+// as Pool.Key when configs for the same server and user may pin
+// different host keys.
+func AddrUserHostKey(net, addr string, config *ssh.ClientConfig) string {
+	key := AddrUserKey(net, addr, config)
+	if config.HostKeyCallback == nil {
+		return key
+	}
+	return key + " config " + strconv.FormatUint(configID(config), 10)
+}
+
+// configIDs numbers configs by identity. Entries are weak, and
+// removed once their config is collected; ids are never reused.
+var configIDs struct {
+	sync.Mutex
+	next uint64
+	m    map[weak.Pointer[ssh.ClientConfig]]uint64
+}
+
+// configID returns the identity number of config.
+func configID(config *ssh.ClientConfig) uint64 {
+	w := weak.Make(config)
+	configIDs.Lock()
+	defer configIDs.Unlock()
+	if id, ok := configIDs.m[w]; ok {
+		return id
+	}
+	if configIDs.m == nil {
+		configIDs.m = make(map[weak.Pointer[ssh.ClientConfig]]uint64)
+	}
+	configIDs.next++
+	configIDs.m[w] = configIDs.next
+	runtime.AddCleanup(config, func(w weak.Pointer[ssh.ClientConfig]) {
+		configIDs.Lock()
+		delete(configIDs.m, w)
+		configIDs.Unlock()
+	}, w)
+	return configIDs.next
+}
+
+// StrictKey is like AddrUserKey, but also distinguishes configs
+// by everything that affects the connection they make: the config's
+// identity, which stands in for its HostKeyCallback and Auth methods
+// as in AddrUserHostKey, and its algorithm choices (Ciphers, MACs,
+// KeyExchanges, and HostKeyAlgorithms) and ClientVersion, so a
+// config changed after use doesn't reuse its old connections. These
+// are hashed into a fixed-size suffix. Connections are shared only
+// by configs that would make the same connection, at the cost of
+// fewer reuses: configs built separately for the same server, even
+// with the same password or keys, get connections of their own.
+// Use it as Pool.Key.
+func StrictKey(net, addr string, config *ssh.ClientConfig) string {
+	h := sha256.New()
+	fmt.Fprintf(h, "%d %q", configID(config), config.ClientVersion)
+	io.WriteString(h, algsKey(config.Ciphers, config.MACs, config.KeyExchanges, config.HostKeyAlgorithms))
+	return AddrUserKey(net, addr, config) + " " + hex.EncodeToString(h.Sum(nil))
+}
+
+// AddrUserCryptoKey is like AddrUserKey, but also distinguishes
+// configs by their Ciphers, MACs, and KeyExchanges, so that a
+// config restricted to strong algorithms never reuses a connection
+// negotiated under a weaker config. Configs listing the same
+// algorithms in the same order share connections. Use it as
+// Pool.Key.
+func AddrUserCryptoKey(net, addr string, config *ssh.ClientConfig) string {
+	return AddrUserKey(net, addr, config) + algsKey(config.Ciphers, config.MACs, config.KeyExchanges)
+}
+
+// algsKey returns a key suffix for lists of algorithm names.
+func algsKey(lists ...[]string) string {
+	var b strings.Builder
+	for _, algs := range lists {
+		b.WriteString(" " + strconv.Quote(strings.Join(algs, ",")))
+	}
+	return b.String()
 }
@@ -0,0 +1,58 @@
+//go:build unix
+
+package sshpool
+
+import (
+	"net"
+	"syscall"
+	"testing"
+)
+
+// sockopt returns the value of c's socket option opt at level.
+func sockopt(t *testing.T, c *net.TCPConn, level, opt int) int {
+	rc, err := c.SyscallConn()
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	var v int
+	var err1 error
+	if err := rc.Control(func(fd uintptr) {
+		v, err1 = syscall.GetsockoptInt(int(fd), level, opt)
+	}); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if err1 != nil {
+		t.Fatal("unexpected error:", err1)
+	}
+	return v
+}
+
+func TestSockOptsApplied(t *testing.T) {
+	for _, opts := range []SockOpts{
+		{NoDelay: true, SendBuffer: 1 << 16, RecvBuffer: 1 << 16},
+		{NoDelay: false},
+	} {
+		p := &Pool{SockOpts: &opts}
+		sess, err := p.Open("tcp", listen(t, new(serverBehavior)), clientConfig)
+		if err != nil {
+			t.Fatal("unexpected error:", err)
+		}
+		sess.Close()
+		var tc *net.TCPConn
+		for _, c := range p.tab {
+			tc = c.netC.(*net.TCPConn)
+		}
+		nodelay := sockopt(t, tc, syscall.IPPROTO_TCP, syscall.TCP_NODELAY) != 0
+		if nodelay != opts.NoDelay {
+			t.Errorf("%+v: TCP_NODELAY = %v want %v", opts, nodelay, opts.NoDelay)
+		}
+		// The kernel may round buffer sizes up, as Linux doubles them.
+		if n := sockopt(t, tc, syscall.SOL_SOCKET, syscall.SO_SNDBUF); opts.SendBuffer > 0 && n < opts.SendBuffer {
+			t.Errorf("%+v: SO_SNDBUF = %d want at least %d", opts, n, opts.SendBuffer)
+		}
+		if n := sockopt(t, tc, syscall.SOL_SOCKET, syscall.SO_RCVBUF); opts.RecvBuffer > 0 && n < opts.RecvBuffer {
+			t.Errorf("%+v: SO_RCVBUF = %d want at least %d", opts, n, opts.RecvBuffer)
+		}
+		p.Close()
+	}
+}
@@ -0,0 +1,85 @@
+// Package sshpoolprom exports sshpool statistics as Prometheus
+// metrics. It is a separate package so that sshpool itself does
+// not depend on the Prometheus client library.
+package sshpoolprom
+
+import (
+	"github.com/kr/sshpool"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	dialsDesc = prometheus.NewDesc(
+		"sshpool_dials_total",
+		"Opens that dialed a new connection.",
+		nil, nil,
+	)
+	sharedDialsDesc = prometheus.NewDesc(
+		"sshpool_shared_dials_total",
+		"Opens that waited for another caller's dial.",
+		nil, nil,
+	)
+	reusedConnsDesc = prometheus.NewDesc(
+		"sshpool_reused_conns_total",
+		"Opens that reused an established connection.",
+		nil, nil,
+	)
+	sessionsDesc = prometheus.NewDesc(
+		"sshpool_sessions_total",
+		"Sessions opened.",
+		nil, nil,
+	)
+	dialErrorsDesc = prometheus.NewDesc(
+		"sshpool_dial_errors_total",
+		"Dials that failed.",
+		nil, nil,
+	)
+	sessionErrorsDesc = prometheus.NewDesc(
+		"sshpool_session_errors_total",
+		"Sessions that failed to open on an established connection.",
+		nil, nil,
+	)
+	openConnsDesc = prometheus.NewDesc(
+		"sshpool_open_conns",
+		"Connections in the pool, including dials in progress.",
+		nil, nil,
+	)
+	liveSessionsDesc = prometheus.NewDesc(
+		"sshpool_live_sessions",
+		"Sessions open or being opened on the pool's connections.",
+		nil, nil,
+	)
+)
+
+// Collector returns a prometheus.Collector that reports
+// p.Stats each time it is collected.
+func Collector(p *sshpool.Pool) prometheus.Collector {
+	return collector{p}
+}
+
+type collector struct {
+	p *sshpool.Pool
+}
+
+func (c collector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- dialsDesc
+	ch <- sharedDialsDesc
+	ch <- reusedConnsDesc
+	ch <- sessionsDesc
+	ch <- dialErrorsDesc
+	ch <- sessionErrorsDesc
+	ch <- openConnsDesc
+	ch <- liveSessionsDesc
+}
+
+func (c collector) Collect(ch chan<- prometheus.Metric) {
+	s := c.p.Stats()
+	ch <- prometheus.MustNewConstMetric(dialsDesc, prometheus.CounterValue, float64(s.TotalDials))
+	ch <- prometheus.MustNewConstMetric(sharedDialsDesc, prometheus.CounterValue, float64(s.SharedDials))
+	ch <- prometheus.MustNewConstMetric(reusedConnsDesc, prometheus.CounterValue, float64(s.ReusedConns))
+	ch <- prometheus.MustNewConstMetric(sessionsDesc, prometheus.CounterValue, float64(s.TotalSessions))
+	ch <- prometheus.MustNewConstMetric(dialErrorsDesc, prometheus.CounterValue, float64(s.DialErrors))
+	ch <- prometheus.MustNewConstMetric(sessionErrorsDesc, prometheus.CounterValue, float64(s.SessionErrors))
+	ch <- prometheus.MustNewConstMetric(openConnsDesc, prometheus.GaugeValue, float64(s.OpenConns))
+	ch <- prometheus.MustNewConstMetric(liveSessionsDesc, prometheus.GaugeValue, float64(s.LiveSessions))
+}
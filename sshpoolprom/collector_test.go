@@ -0,0 +1,36 @@
+package sshpoolprom
+
+import (
+	"github.com/kr/sshpool"
+	"github.com/prometheus/client_golang/prometheus"
+	"testing"
+)
+
+func TestCollector(t *testing.T) {
+	reg := prometheus.NewPedanticRegistry()
+	if err := reg.Register(Collector(new(sshpool.Pool))); err != nil {
+		t.Fatal("unable to register:", err)
+	}
+	mfs, err := reg.Gather()
+	if err != nil {
+		t.Fatal("unable to gather:", err)
+	}
+	want := []string{
+		"sshpool_dial_errors_total",
+		"sshpool_dials_total",
+		"sshpool_live_sessions",
+		"sshpool_open_conns",
+		"sshpool_reused_conns_total",
+		"sshpool_session_errors_total",
+		"sshpool_sessions_total",
+		"sshpool_shared_dials_total",
+	}
+	if len(mfs) != len(want) {
+		t.Fatalf("got %d metric families want %d", len(mfs), len(want))
+	}
+	for i, mf := range mfs {
+		if mf.GetName() != want[i] {
+			t.Errorf("family %d = %s want %s", i, mf.GetName(), want[i])
+		}
+	}
+}
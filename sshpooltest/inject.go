@@ -0,0 +1,60 @@
+// Package sshpooltest provides fault injection for testing code
+// that uses sshpool. It lets callers check their retry and error
+// handling against a pool without an unreliable server.
+package sshpooltest
+
+import (
+	"github.com/kr/sshpool"
+	"golang.org/x/crypto/ssh"
+	"net"
+	"sync"
+)
+
+// InjectDialError makes every dial by p after the first afterN
+// fail with err, without calling the underlying dialer. Dials are
+// counted across all keys. Like p.Use, it must be called before
+// p is used.
+func InjectDialError(p *sshpool.Pool, afterN int, err error) {
+	var (
+		mu sync.Mutex
+		n  int
+	)
+	p.Use(func(next sshpool.DialFunc) sshpool.DialFunc {
+		return func(network, addr string) (net.Conn, error) {
+			mu.Lock()
+			n++
+			fail := n > afterN
+			mu.Unlock()
+			if fail {
+				return nil, err
+			}
+			return next(network, addr)
+		}
+	})
+}
+
+// InjectSessionError makes every session opened by p after the
+// first afterN fail with err, without opening a channel on the
+// connection. Sessions are counted across all connections. It
+// wraps p.NewSession, so it must be called after any NewSession
+// is set and before p is used.
+func InjectSessionError(p *sshpool.Pool, afterN int, err error) {
+	var (
+		mu sync.Mutex
+		n  int
+	)
+	next := p.NewSession
+	if next == nil {
+		next = (*ssh.Client).NewSession
+	}
+	p.NewSession = func(c *ssh.Client) (*ssh.Session, error) {
+		mu.Lock()
+		n++
+		fail := n > afterN
+		mu.Unlock()
+		if fail {
+			return nil, err
+		}
+		return next(c)
+	}
+}
@@ -0,0 +1,96 @@
+package sshpooltest
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"github.com/kr/sshpool"
+	"golang.org/x/crypto/ssh"
+	"net"
+	"testing"
+)
+
+func TestInjectDialError(t *testing.T) {
+	errBase := errors.New("base error")
+	errInjected := errors.New("injected error")
+	c := 0
+	p := &sshpool.Pool{Dial: func(net, addr string) (net.Conn, error) {
+		c++
+		return nil, errBase
+	}}
+	InjectDialError(p, 2, errInjected)
+	config := &ssh.ClientConfig{User: "u"}
+	want := []error{errBase, errBase, errInjected, errInjected}
+	for i, w := range want {
+		_, err := p.Open("net", string(rune('a'+i)), config)
+		if !errors.Is(err, w) {
+			t.Errorf("open %d: err = %v want %v", i, err, w)
+		}
+	}
+	if c != 2 {
+		t.Fatalf("calls = %d want 2", c)
+	}
+}
+
+// serve starts an SSH server for one connection, accepting
+// any user and any session, and returns a connection to it.
+func serve(t *testing.T) net.Conn {
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := &ssh.ServerConfig{NoClientAuth: true}
+	config.AddHostKey(signer)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("unable to listen:", err)
+	}
+	go func() {
+		defer l.Close()
+		c, err := l.Accept()
+		if err != nil {
+			return
+		}
+		_, chans, reqs, err := ssh.NewServerConn(c, config)
+		if err != nil {
+			return
+		}
+		go ssh.DiscardRequests(reqs)
+		for nc := range chans {
+			ch, reqs, err := nc.Accept()
+			if err != nil {
+				continue
+			}
+			go ssh.DiscardRequests(reqs)
+			defer ch.Close()
+		}
+	}()
+	c, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal("unable to dial test server:", err)
+	}
+	return c
+}
+
+func TestInjectSessionError(t *testing.T) {
+	errInjected := errors.New("injected error")
+	p := &sshpool.Pool{Dial: func(net, addr string) (net.Conn, error) {
+		return serve(t), nil
+	}, MaxAttempts: 1}
+	defer p.Close()
+	InjectSessionError(p, 2, errInjected)
+	config := &ssh.ClientConfig{User: "u", HostKeyCallback: ssh.InsecureIgnoreHostKey()}
+	for i := 0; i < 4; i++ {
+		_, err := p.Open("net", "addr", config)
+		if i < 2 && err != nil {
+			t.Fatalf("open %d: unexpected error: %v", i, err)
+		}
+		if i >= 2 && !errors.Is(err, errInjected) {
+			t.Fatalf("open %d: err = %v want %v", i, err, errInjected)
+		}
+	}
+}